@@ -0,0 +1,534 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// arithmeticError is an expression that could not be evaluated. Like bash,
+// it names the token where evaluation failed.
+type arithmeticError struct {
+	expr    string
+	message string
+	token   string
+}
+
+func (e *arithmeticError) Error() string {
+	return fmt.Sprintf("%s: %s (error token is \"%s\")", e.expr, e.message, e.token)
+}
+
+// arithmeticOperators are the operators of arithmetic expressions, longest
+// first so that scanning picks "<<=" over "<<" and "<".
+var arithmeticOperators = []string{
+	"<<=", ">>=",
+	"**", "++", "--", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"*=", "/=", "%=", "+=", "-=", "&=", "^=", "|=",
+	"+", "-", "*", "/", "%", "<", ">", "&", "|", "^", "!", "~", "?", ":", "=", "(", ")", ",",
+}
+
+// binaryPrecedence lists the left associative binary operators from the
+// loosest to the tightest binding. ** binds tighter still and is handled on
+// its own, being right associative.
+var binaryPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<", ">", "<=", ">="},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+var assignmentOperators = []string{"=", "*=", "/=", "%=", "+=", "-=", "<<=", ">>=", "&=", "^=", "|="}
+
+// maxArithmeticDepth bounds how deep variables holding expressions may
+// refer to each other, so that a=a fails instead of recursing forever.
+const maxArithmeticDepth = 1024
+
+type arithmeticTokenType int
+
+const (
+	arithmeticEnd arithmeticTokenType = iota
+	arithmeticNumber
+	arithmeticName
+	arithmeticOperator
+)
+
+// arithmetic evaluates an expression while parsing it, the way bash does.
+// Operands that are skipped, such as the right side of a false &&, are
+// still parsed but with noeval set, so they neither assign nor fail.
+type arithmetic struct {
+	expr  string
+	vars  *variableStore
+	depth int
+	// pos is where scanning resumes, start where the current token tok
+	// begins and prev is the token before it.
+	pos    int
+	start  int
+	tok    string
+	kind   arithmeticTokenType
+	prev   string
+	noeval int
+	err    error
+}
+
+// evaluateArithmetic computes the value of an integer expression, in which
+// variables are referred to by name. An empty expression is 0.
+func evaluateArithmetic(expr string, vars *variableStore) (int64, error) {
+	return evaluateNested(expr, vars, 0)
+}
+
+func evaluateNested(expr string, vars *variableStore, depth int) (int64, error) {
+	a := &arithmetic{expr: expr, vars: vars, depth: depth}
+	a.next()
+	if a.kind == arithmeticEnd {
+		return 0, nil
+	}
+	value := a.comma()
+	if a.kind != arithmeticEnd {
+		a.fail("syntax error in expression", a.rest())
+	}
+	return value, a.err
+}
+
+// next scans the token following the current one.
+func (a *arithmetic) next() {
+	a.prev = a.tok
+	for a.pos < len(a.expr) && strings.IndexByte(" \t\n", a.expr[a.pos]) >= 0 {
+		a.pos++
+	}
+	a.start = a.pos
+	if a.pos == len(a.expr) {
+		a.tok, a.kind = "", arithmeticEnd
+		return
+	}
+
+	ch := a.expr[a.pos]
+	switch {
+	case isDigit(ch):
+		for a.pos < len(a.expr) && (isNameChar(a.expr[a.pos]) || a.expr[a.pos] == '#' || a.expr[a.pos] == '@') {
+			a.pos++
+		}
+		a.kind = arithmeticNumber
+	case isNameStart(ch):
+		for a.pos < len(a.expr) && isNameChar(a.expr[a.pos]) {
+			a.pos++
+		}
+		if a.pos < len(a.expr) && a.expr[a.pos] == '[' {
+			a.subscript()
+		}
+		a.kind = arithmeticName
+	default:
+		a.kind = arithmeticOperator
+		for _, op := range arithmeticOperators {
+			if strings.HasPrefix(a.expr[a.pos:], op) {
+				a.pos += len(op)
+				break
+			}
+		}
+		if a.pos == a.start {
+			a.fail("syntax error: invalid arithmetic operator", a.rest())
+			a.pos = len(a.expr)
+		}
+	}
+	a.tok = a.expr[a.start:a.pos]
+}
+
+// subscript extends a name token with the subscript of an array element,
+// through the matching bracket.
+func (a *arithmetic) subscript() {
+	depth := 0
+	for i := a.pos; i < len(a.expr); i++ {
+		switch a.expr[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				a.pos = i + 1
+				return
+			}
+		}
+	}
+	a.fail("bad array subscript", a.expr[a.start:])
+	a.pos = len(a.expr)
+}
+
+// rest is the text from the current token on, or the previous token at the
+// end of the expression.
+func (a *arithmetic) rest() string {
+	if a.kind == arithmeticEnd {
+		return a.prev
+	}
+	return strings.TrimSpace(a.expr[a.start:])
+}
+
+// fail records the first error. Parsing goes on, but its results no longer
+// matter.
+func (a *arithmetic) fail(message string, token string) {
+	if a.err != nil {
+		return
+	}
+	a.err = &arithmeticError{expr: strings.TrimSpace(a.expr), message: message, token: token}
+}
+
+func (a *arithmetic) isOperator(ops ...string) bool {
+	if a.kind != arithmeticOperator {
+		return false
+	}
+	for _, op := range ops {
+		if a.tok == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *arithmetic) comma() int64 {
+	value := a.assignment()
+	for a.err == nil && a.isOperator(",") {
+		a.next()
+		value = a.assignment()
+	}
+	return value
+}
+
+func (a *arithmetic) assignment() int64 {
+	if a.kind == arithmeticName {
+		name := a.tok
+		pos, start, tok, prev := a.pos, a.start, a.tok, a.prev
+		a.next()
+		if a.isOperator(assignmentOperators...) {
+			op := a.tok
+			a.next()
+			value := a.assignment()
+			if op != "=" {
+				value = a.binary(op[:len(op)-1], a.variable(name), value, "")
+			}
+			return a.assign(name, value)
+		}
+		a.pos, a.start, a.tok, a.kind, a.prev = pos, start, tok, arithmeticName, prev
+	}
+	return a.conditional()
+}
+
+func (a *arithmetic) conditional() int64 {
+	condition := a.binaryLevel(0)
+	if !a.isOperator("?") {
+		return condition
+	}
+	a.next()
+	if condition == 0 {
+		a.noeval++
+	}
+	yes := a.comma()
+	if condition == 0 {
+		a.noeval--
+	}
+	if !a.isOperator(":") {
+		a.fail("`:' expected for conditional expression", a.rest())
+		return 0
+	}
+	a.next()
+	if condition != 0 {
+		a.noeval++
+	}
+	no := a.assignment()
+	if condition != 0 {
+		a.noeval--
+		return yes
+	}
+	return no
+}
+
+func (a *arithmetic) binaryLevel(level int) int64 {
+	if level == len(binaryPrecedence) {
+		return a.power()
+	}
+	value := a.binaryLevel(level + 1)
+	for a.err == nil && a.isOperator(binaryPrecedence[level]...) {
+		op := a.tok
+		skip := op == "&&" && value == 0 || op == "||" && value != 0
+		a.next()
+		start := a.start
+		if skip {
+			a.noeval++
+		}
+		right := a.binaryLevel(level + 1)
+		if skip {
+			a.noeval--
+		}
+		value = a.binary(op, value, right, a.expr[start:a.start])
+	}
+	return value
+}
+
+func (a *arithmetic) power() int64 {
+	base := a.unary()
+	if !a.isOperator("**") {
+		return base
+	}
+	a.next()
+	start := a.start
+	exponent := a.power()
+	return a.binary("**", base, exponent, a.expr[start:a.start])
+}
+
+func (a *arithmetic) unary() int64 {
+	if a.kind != arithmeticOperator {
+		return a.postfix()
+	}
+	op := a.tok
+	switch op {
+	case "!":
+		a.next()
+		return boolValue(a.unary() == 0)
+	case "~":
+		a.next()
+		return ^a.unary()
+	case "-":
+		a.next()
+		return -a.unary()
+	case "+":
+		a.next()
+		return a.unary()
+	case "++", "--":
+		a.next()
+		if a.kind != arithmeticName {
+			// Without a variable to change, ++5 is +(+5) and --5 is -(-5).
+			return a.unary()
+		}
+		name := a.tok
+		a.next()
+		return a.assign(name, a.variable(name)+increment(op))
+	}
+	return a.postfix()
+}
+
+func (a *arithmetic) postfix() int64 {
+	switch {
+	case a.kind == arithmeticNumber:
+		text := a.tok
+		a.next()
+		return a.number(text)
+	case a.kind == arithmeticName:
+		name := a.tok
+		a.next()
+		value := a.variable(name)
+		if a.isOperator("++", "--") {
+			a.assign(name, value+increment(a.tok))
+			a.next()
+		}
+		return value
+	case a.isOperator("("):
+		a.next()
+		value := a.comma()
+		if !a.isOperator(")") {
+			a.fail("missing `)'", a.rest())
+			return 0
+		}
+		a.next()
+		return value
+	}
+	a.fail("syntax error: operand expected", a.rest())
+	return 0
+}
+
+func increment(op string) int64 {
+	if op == "--" {
+		return -1
+	}
+	return 1
+}
+
+// binary applies a binary operator. operand is the text of the right
+// operand, which division by zero names as the culprit.
+func (a *arithmetic) binary(op string, left int64, right int64, operand string) int64 {
+	switch op {
+	case "||":
+		return boolValue(left != 0 || right != 0)
+	case "&&":
+		return boolValue(left != 0 && right != 0)
+	case "|":
+		return left | right
+	case "^":
+		return left ^ right
+	case "&":
+		return left & right
+	case "==":
+		return boolValue(left == right)
+	case "!=":
+		return boolValue(left != right)
+	case "<":
+		return boolValue(left < right)
+	case ">":
+		return boolValue(left > right)
+	case "<=":
+		return boolValue(left <= right)
+	case ">=":
+		return boolValue(left >= right)
+	case "<<":
+		return left << (uint64(right) & 63)
+	case ">>":
+		return left >> (uint64(right) & 63)
+	case "+":
+		return left + right
+	case "-":
+		return left - right
+	case "*":
+		return left * right
+	case "/", "%":
+		if right == 0 {
+			if a.noeval == 0 {
+				a.fail("division by 0", strings.TrimSpace(operand))
+			}
+			return 0
+		}
+		if op == "/" {
+			return left / right
+		}
+		return left % right
+	case "**":
+		if right < 0 {
+			if a.noeval == 0 {
+				a.fail("exponent less than 0", strings.TrimSpace(operand))
+			}
+			return 0
+		}
+		return intPower(left, right)
+	}
+	return 0
+}
+
+// intPower raises base to a non-negative exponent by repeated squaring. It
+// wraps around on overflow just like multiplying base exponent times.
+func intPower(base int64, exponent int64) int64 {
+	result := int64(1)
+	for ; exponent > 0; exponent >>= 1 {
+		if exponent&1 == 1 {
+			result *= base
+		}
+		base *= base
+	}
+	return result
+}
+
+// variable is the value of a variable as a number. Unset and empty
+// variables are 0, and a value that is itself an expression is evaluated.
+func (a *arithmetic) variable(name string) int64 {
+	if a.noeval > 0 || a.err != nil {
+		return 0
+	}
+	var value string
+	if base, subscript, ok := splitElement(name); ok {
+		value, _ = a.vars.element(base, subscript)
+	} else {
+		value, _ = a.vars.get(name)
+	}
+	if strings.TrimSpace(value) == "" {
+		return 0
+	}
+	if a.depth >= maxArithmeticDepth {
+		a.fail("expression recursion level exceeded", name)
+		return 0
+	}
+	result, err := evaluateNested(value, a.vars, a.depth+1)
+	if err != nil && a.err == nil {
+		a.err = err
+	}
+	return result
+}
+
+func (a *arithmetic) assign(name string, value int64) int64 {
+	if a.noeval > 0 || a.err != nil {
+		return value
+	}
+	text := strconv.FormatInt(value, 10)
+	var err error
+	if base, subscript, ok := splitElement(name); ok {
+		err = a.vars.setElement(base, subscript, text)
+	} else {
+		err = a.vars.set(name, text)
+	}
+	if err != nil {
+		a.err = err
+	}
+	return value
+}
+
+// splitElement splits a reference to an array element like name[subscript]
+// into the name and the subscript.
+func splitElement(ref string) (string, string, bool) {
+	i := strings.IndexByte(ref, '[')
+	if i < 0 || !strings.HasSuffix(ref, "]") {
+		return ref, "", false
+	}
+	return ref[:i], ref[i+1 : len(ref)-1], true
+}
+
+// number parses an integer constant: decimal, octal with a leading 0,
+// hexadecimal with 0x, or base#digits for any base from 2 to 64.
+func (a *arithmetic) number(text string) int64 {
+	base := 10
+	digits := text
+	switch {
+	case strings.Contains(text, "#"):
+		i := strings.IndexByte(text, '#')
+		b, err := strconv.Atoi(text[:i])
+		if err != nil || b < 2 || b > 64 {
+			a.fail("invalid arithmetic base", text)
+			return 0
+		}
+		base, digits = b, text[i+1:]
+		if digits == "" {
+			a.fail("invalid integer constant", text)
+			return 0
+		}
+	case strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X"):
+		base, digits = 16, text[2:]
+	case len(text) > 1 && text[0] == '0':
+		base, digits = 8, text[1:]
+	}
+
+	var value int64
+	for i := 0; i < len(digits); i++ {
+		d := digitValue(digits[i], base)
+		if d < 0 || d >= base {
+			a.fail("value too great for base", text)
+			return 0
+		}
+		value = value*int64(base) + int64(d)
+	}
+	return value
+}
+
+// digitValue is the value of a digit in base. Letters count from 10 on and
+// only differ by case above base 36, followed by @ and _.
+func digitValue(ch byte, base int) int {
+	switch {
+	case isDigit(ch):
+		return int(ch - '0')
+	case 'a' <= ch && ch <= 'z':
+		return int(ch-'a') + 10
+	case 'A' <= ch && ch <= 'Z' && base > 36:
+		return int(ch-'A') + 36
+	case 'A' <= ch && ch <= 'Z':
+		return int(ch-'A') + 10
+	case ch == '@':
+		return 62
+	case ch == '_':
+		return 63
+	}
+	return -1
+}
+
+func boolValue(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// word is a single shell word as written on the command line. Its parts are
+// the lexer tokens that were glued together without separating whitespace,
+// so quoting information survives until expansion.
+type word struct {
+	parts []Token
+}
+
+// String rebuilds the word as shell text, for use in error messages and
+// listings. Quoted parts are written in double quotes.
+func (w word) String() string {
+	var b strings.Builder
+	inQuotes := false
+	for i, t := range w.parts {
+		if t.quoted != inQuotes {
+			b.WriteByte('"')
+			inQuotes = t.quoted
+		}
+		switch {
+		case t.tType == VARIABLE:
+			next := ""
+			if i+1 < len(w.parts) {
+				next = w.parts[i+1].literal
+			}
+			special := len(t.literal) == 1 && !isNameStart(t.literal[0])
+			if !special && (!isValidName(t.literal) || next != "" && isNameChar(next[0])) {
+				b.WriteString("${" + t.literal + "}")
+				break
+			}
+			b.WriteString("$" + t.literal)
+		case t.tType == COMMANDSUB:
+			b.WriteString("$(" + t.literal + ")")
+		case t.tType == ARITHMETIC:
+			b.WriteString("$((" + t.literal + "))")
+		case t.tType == BACKWARD:
+			b.WriteString("\\" + t.literal)
+		case t.quoted:
+			for j := 0; j < len(t.literal); j++ {
+				if strings.IndexByte("\"\\$`", t.literal[j]) >= 0 {
+					b.WriteByte('\\')
+				}
+				b.WriteByte(t.literal[j])
+			}
+		default:
+			b.WriteString(t.literal)
+		}
+	}
+	if inQuotes {
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+func (w word) isQuoted() bool {
+	for _, t := range w.parts {
+		if t.quoted {
+			return true
+		}
+	}
+	return false
+}
+
+func (w word) hasSubstitution() bool {
+	for _, t := range w.parts {
+		if t.tType == COMMANDSUB {
+			return true
+		}
+	}
+	return false
+}
+
+type assignmentNode struct {
+	name string
+	// subscript is set for name[subscript]=value.
+	subscript *word
+	value     word
+	// array is set for name=( ... ), which assigns elements instead of
+	// value.
+	array    bool
+	elements []arrayElement
+}
+
+// arrayElement is a word of an array assignment such as arr=(a [5]=b). key
+// is nil unless the element has a [key]= subscript.
+type arrayElement struct {
+	key   *word
+	value word
+}
+
+func (a assignmentNode) hasSubstitution() bool {
+	for _, e := range a.elements {
+		if e.value.hasSubstitution() {
+			return true
+		}
+	}
+	return a.value.hasSubstitution()
+}
+
+func (a assignmentNode) String() string {
+	text := a.name
+	if a.subscript != nil {
+		text += "[" + a.subscript.String() + "]"
+	}
+	if !a.array {
+		return text + "=" + a.value.String()
+	}
+	elements := []string{}
+	for _, e := range a.elements {
+		element := e.value.String()
+		if e.key != nil {
+			element = "[" + e.key.String() + "]=" + element
+		}
+		elements = append(elements, element)
+	}
+	return text + "=(" + strings.Join(elements, " ") + ")"
+}
+
+// redirection is an operator such as 2>> together with its target word. fd
+// is -1 when the operator's default descriptor applies. Here-documents keep
+// their delimiter next to the body they read.
+type redirection struct {
+	fd        int
+	op        string
+	target    word
+	delimiter string
+}
+
+type commandNode interface {
+	commandNode()
+}
+
+type simpleCommand struct {
+	assignments  []assignmentNode
+	words        []word
+	redirections []redirection
+}
+
+// functionDefinition is a name() { ...; } command. Running it only records
+// the body under the name. source is the definition as it was written,
+// which recreates the function in a subshell.
+type functionDefinition struct {
+	name   string
+	body   compoundNode
+	source string
+	// defined is where the definition was run, which the lines of the
+	// body count from.
+	defined location
+}
+
+// compound holds what all compound commands have in common: redirections
+// that apply to every command inside them.
+type compound struct {
+	redirections []redirection
+}
+
+func (c *compound) redirects() []redirection { return c.redirections }
+
+func (c *compound) addRedirection(r redirection) {
+	c.redirections = append(c.redirections, r)
+}
+
+// compoundNode is a command built from lists of other commands, such as
+// if or a { ...; } group.
+type compoundNode interface {
+	commandNode
+	redirects() []redirection
+	addRedirection(r redirection)
+}
+
+type braceGroup struct {
+	compound
+	body *commandList
+}
+
+// subshell is a ( ... ) group. It runs in a separate instance of the shell
+// started with source, the text between the parentheses.
+type subshell struct {
+	compound
+	body   *commandList
+	source string
+}
+
+// conditional is an if or elif test together with the list it guards.
+type conditional struct {
+	condition *commandList
+	body      *commandList
+}
+
+type ifCommand struct {
+	compound
+	clauses  []conditional
+	elseBody *commandList
+}
+
+// loop is a while loop, or an until loop when until is set.
+type loop struct {
+	compound
+	until     bool
+	condition *commandList
+	body      *commandList
+}
+
+// forLoop assigns name each of words in turn, or each positional parameter
+// when the loop has no in clause.
+type forLoop struct {
+	compound
+	name       string
+	words      []word
+	positional bool
+	body       *commandList
+}
+
+// arithmeticCommand is a (( expr )) command, which succeeds when expr is
+// not zero.
+type arithmeticCommand struct {
+	compound
+	expr string
+}
+
+type caseItem struct {
+	patterns []word
+	body     *commandList
+}
+
+type caseCommand struct {
+	compound
+	subject word
+	items   []caseItem
+}
+
+type pipeline struct {
+	// line is the line of the input the pipeline starts on.
+	line     int
+	commands []commandNode
+	// sources holds the text of each command, for running it in a subshell.
+	sources []string
+}
+
+// pipelineOf returns a pipeline made of a single command.
+func pipelineOf(node commandNode, source string) *pipeline {
+	return &pipeline{commands: []commandNode{node}, sources: []string{source}}
+}
+
+// listEntry is a pipeline together with the operator (;, && or ||) that
+// joins it to the previous entry of the list. background is set when the
+// pipeline was terminated by &.
+type listEntry struct {
+	operator   TokenType
+	pipeline   *pipeline
+	background bool
+}
+
+type commandList struct {
+	entries []listEntry
+}
+
+func (*simpleCommand) commandNode() {}
+
+// String rebuilds the command as text, the way job listings show it.
+func (c *simpleCommand) String() string {
+	parts := []string{}
+	for _, a := range c.assignments {
+		parts = append(parts, a.String())
+	}
+	for _, w := range c.words {
+		parts = append(parts, w.String())
+	}
+	for _, r := range c.redirections {
+		parts = append(parts, r.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (r redirection) String() string {
+	op := r.op
+	if r.fd >= 0 {
+		op = strconv.Itoa(r.fd) + op
+	}
+	if isHeredoc(r.op) {
+		return op + r.delimiter
+	}
+	return op + r.target.String()
+}
+
+func (*functionDefinition) commandNode() {}
+func (*braceGroup) commandNode()         {}
+func (*subshell) commandNode()           {}
+func (*ifCommand) commandNode()          {}
+func (*loop) commandNode()               {}
+func (*forLoop) commandNode()            {}
+func (*caseCommand) commandNode()        {}
+func (*arithmeticCommand) commandNode()  {}
+
+func (f *functionDefinition) String() string {
+	return fmt.Sprintf("%s () %s", f.name, f.body)
+}
+
+func (g *braceGroup) String() string {
+	return "{ " + terminated(g.body) + " }" + g.redirectionText()
+}
+
+func (s *subshell) String() string {
+	return "(" + s.body.String() + ")" + s.redirectionText()
+}
+
+func (c *ifCommand) String() string {
+	var b strings.Builder
+	for i, clause := range c.clauses {
+		if i == 0 {
+			b.WriteString("if ")
+		} else {
+			b.WriteString(" elif ")
+		}
+		b.WriteString(terminated(clause.condition) + " then " + terminated(clause.body))
+	}
+	if c.elseBody != nil {
+		b.WriteString(" else " + terminated(c.elseBody))
+	}
+	return b.String() + " fi" + c.redirectionText()
+}
+
+func (l *loop) String() string {
+	keyword := "while"
+	if l.until {
+		keyword = "until"
+	}
+	return keyword + " " + terminated(l.condition) + " do " + terminated(l.body) + " done" + l.redirectionText()
+}
+
+func (f *forLoop) String() string {
+	text := "for " + f.name
+	if !f.positional {
+		text += " in"
+		for _, w := range f.words {
+			text += " " + w.String()
+		}
+	}
+	return text + "; do " + terminated(f.body) + " done" + f.redirectionText()
+}
+
+func (c *caseCommand) String() string {
+	var b strings.Builder
+	b.WriteString("case " + c.subject.String() + " in")
+	for _, item := range c.items {
+		patterns := []string{}
+		for _, p := range item.patterns {
+			patterns = append(patterns, p.String())
+		}
+		b.WriteString(" " + strings.Join(patterns, " | ") + ") ")
+		if len(item.body.entries) > 0 {
+			b.WriteString(item.body.String() + " ")
+		}
+		b.WriteString(";;")
+	}
+	return b.String() + " esac" + c.redirectionText()
+}
+
+func (c *arithmeticCommand) String() string {
+	return "((" + c.expr + "))" + c.redirectionText()
+}
+
+func (c *compound) redirectionText() string {
+	text := ""
+	for _, r := range c.redirections {
+		text += " " + r.String()
+	}
+	return text
+}
+
+// terminated renders a list followed by the ; that ends it, unless its last
+// command already ends in &.
+func terminated(l *commandList) string {
+	if n := len(l.entries); n > 0 && l.entries[n-1].background {
+		return l.String()
+	}
+	return l.String() + ";"
+}
+
+func (p *pipeline) String() string {
+	commands := []string{}
+	for _, c := range p.commands {
+		commands = append(commands, fmt.Sprint(c))
+	}
+	return strings.Join(commands, " | ")
+}
+
+func (l *commandList) String() string {
+	var b strings.Builder
+	for i, e := range l.entries {
+		switch {
+		case i == 0:
+		case e.operator == AND:
+			b.WriteString(" && ")
+		case e.operator == OR:
+			b.WriteString(" || ")
+		case l.entries[i-1].background:
+			b.WriteString(" ")
+		default:
+			b.WriteString("; ")
+		}
+		b.WriteString(e.pipeline.String())
+		if e.background {
+			b.WriteString(" &")
+		}
+	}
+	return b.String()
+}
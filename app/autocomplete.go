@@ -29,6 +29,20 @@ func (t *trieNode) insert(word string) {
 	current.children["*"] = nil
 }
 
+// remove unmarks word as complete. The nodes on its path stay, as other
+// words may share them.
+func (t *trieNode) remove(word string) {
+	current := t
+	for _, c := range word {
+		n, ok := current.children[string(c)]
+		if !ok {
+			return
+		}
+		current = n
+	}
+	delete(current.children, "*")
+}
+
 func (t *trieNode) search(word string) bool {
 	current := t
 	for _, c := range word {
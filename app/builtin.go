@@ -6,19 +6,84 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"golang.org/x/term"
 )
 
-type builtin func(in io.Reader, out io.Writer, args []string, termState *term.State, historyList *[]string) error
+type builtin func(in io.Reader, out io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error
 
 type builtInMenu struct {
-	commands   map[string]builtin
+	commands map[string]builtin
+	// prefixTrie holds the names TAB completes. It is built by
+	// completionTrie the first time it is needed.
 	prefixTrie *trieNode
 	history    []string
 	cmdIndex   int
+	vars       *variableStore
+	aliases    map[string]string
+	functions  map[string]*functionDefinition
+	jobs       *jobTable
+	termState  *term.State
+	// interactive is set when commands come from the line editor rather
+	// than from a script, a -c string or a pipe.
+	interactive bool
+	// sourcing counts the files being run by source, in which return is
+	// allowed just like in functions.
+	sourcing int
+	// returning is set by return and makes every list stop until the
+	// function or sourced file it returns from is done.
+	returning bool
+	// loops counts the loops being run. breaks and continues are the
+	// number of them that break and continue still have to leave.
+	loops     int
+	breaks    int
+	continues int
+	// aborting is set by the errors that, as in bash, abandon the rest of
+	// the command line, such as an arithmetic error.
+	aborting bool
+	// location is where the commands being run were read from.
+	location location
+}
+
+// location places the commands being run in the script they come from, for
+// the diagnostics of a shell that is not interactive. name is empty for
+// lines typed at the prompt.
+type location struct {
+	name string
+	// base is the number of lines of the script ahead of the command list
+	// being run, whose pipelines count their lines from one.
+	base int
+	// line is the line of the pipeline being run.
+	line int
+}
+
+// diagnosticPrefix is what the shell's error messages start with. Like
+// bash, the shell says where in a script an error happened.
+func (bM *builtInMenu) diagnosticPrefix() string {
+	if bM.location.name == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s: line %d: ", bM.location.name, bM.location.line)
+}
+
+// errorf prints a diagnostic of the shell to w.
+func (bM *builtInMenu) errorf(w io.Writer, format string, args ...any) {
+	fmt.Fprintf(w, "%s%s\n", bM.diagnosticPrefix(), fmt.Sprintf(format, args...))
+}
+
+// diagnostics returns the standard error to hand a builtin, which puts the
+// diagnostic prefix in front of each line it writes.
+func (bM *builtInMenu) diagnostics(f *os.File) io.Writer {
+	prefix := bM.diagnosticPrefix()
+	if prefix == "" {
+		return f
+	}
+	return &diagnosticWriter{f: f, prefix: prefix}
 }
 
 func (bM builtInMenu) isBuiltIn(cmd string) bool {
@@ -26,47 +91,233 @@ func (bM builtInMenu) isBuiltIn(cmd string) bool {
 	return ok
 }
 
+// unwinding reports whether return, break, continue or an error abandoning
+// the command line is leaving the commands being run.
+func (bM *builtInMenu) unwinding() bool {
+	return bM.returning || bM.aborting || bM.breaks > 0 || bM.continues > 0
+}
+
+// endIteration is called by loops after their condition and body. It
+// consumes a pending break or continue meant for the loop and reports
+// whether the loop is over. An interrupt after the loop counted interrupts
+// ends it as well.
+func (bM *builtInMenu) endIteration(interrupts int) bool {
+	switch {
+	case bM.breaks > 0:
+		bM.breaks--
+		return true
+	case bM.continues > 0:
+		bM.continues--
+		return bM.continues > 0
+	}
+	return bM.returning || bM.aborting || bM.jobs.interruptCount() != interrupts
+}
+
+// stateScript returns commands that recreate the functions and variables of
+// the shell in another instance of it. Exported variables are left out, as
+// they reach it through the environment, except for arrays, which cannot.
+func (bM *builtInMenu) stateScript() string {
+	var b strings.Builder
+	names := []string{}
+	for name := range bM.functions {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		b.WriteString(bM.functions[name].source + "\n")
+	}
+	for _, name := range shellOptions {
+		if bM.vars.options[name] {
+			fmt.Fprintf(&b, "shopt -s %s\n", name)
+		}
+	}
+	for _, name := range bM.vars.sortedNames() {
+		v := bM.vars.values[name]
+		if v.isArray() || v.unset {
+			b.WriteString(bM.vars.declaration(name, singleQuote) + "\n")
+			continue
+		}
+		if !v.exported {
+			fmt.Fprintf(&b, "%s=%s\n", name, singleQuote(v.value))
+		}
+		if v.readonly {
+			fmt.Fprintf(&b, "readonly %s\n", name)
+		}
+	}
+	return b.String()
+}
+
+// subshellStateVariable hands the state of the shell to the subshells it
+// starts. They are new processes and would otherwise begin with their own
+// $$ and neither $? nor $!.
+const subshellStateVariable = "GOSH_SUBSHELL_STATE"
+
+// subshellState returns the environment entry for a subshell: $$, $?, $!
+// and the line being run on the first line, followed by the stateScript.
+// It is kept apart from the commands the subshell runs so that the script
+// cannot disturb $? or the line numbers of those commands.
+func (bM *builtInMenu) subshellState() string {
+	line := bM.location.line
+	if bM.location.name == "" {
+		line = 0
+	}
+	return fmt.Sprintf("%s=%d %d %d %d\n%s", subshellStateVariable,
+		bM.vars.pid, bM.vars.lastStatus, bM.vars.lastBgPid, line, bM.stateScript())
+}
+
+// restoreState recreates the state a parent shell passed down with
+// subshellState. It returns the line of the parent that started the
+// subshell, or 0 when the parent was reading lines typed at the prompt.
+func (bM *builtInMenu) restoreState(state string) int {
+	header, script, _ := strings.Cut(state, "\n")
+	var pid, status, bgPid, line int
+	if _, err := fmt.Sscan(header, &pid, &status, &bgPid, &line); err != nil {
+		return 0
+	}
+	// Functions remember where they were defined, which is nowhere if the
+	// parent was reading typed lines.
+	name := bM.vars.shellName
+	if line == 0 {
+		name = ""
+	}
+	runScript(strings.NewReader(script), name, 1, bM, standardFds())
+	bM.vars.pid, bM.vars.lastStatus, bM.vars.lastBgPid = pid, status, bgPid
+	return line
+}
+
+// detached returns a view of the shell for command substitutions. It
+// shares the shell's state but not its job table, so the commands they run
+// never take the terminal.
+func (bM *builtInMenu) detached() *builtInMenu {
+	copied := *bM
+	copied.jobs = newJobTable(false)
+	return &copied
+}
+
+// aliasTable returns the aliases the parser expands. Like bash, only
+// interactive shells expand aliases.
+func (bM *builtInMenu) aliasTable() map[string]string {
+	if !bM.interactive {
+		return nil
+	}
+	return bM.aliases
+}
+
 var typeCmd builtin
 
 var builtInCommandMap = map[string]builtin{
-	"exit":    exit,
-	"echo":    echo,
-	"type":    typeCmd,
-	"pwd":     pwd,
-	"cd":      cd,
-	"history": history,
+	"exit":     exit,
+	"echo":     echo,
+	"type":     typeCmd,
+	"pwd":      pwd,
+	"cd":       cd,
+	"history":  history,
+	"export":   export,
+	"unset":    unset,
+	"env":      env,
+	"readonly": readonly,
+	"jobs":     jobs,
+	"fg":       fg,
+	"bg":       bg,
+	"wait":     wait,
+	"disown":   disown,
+	"kill":     kill,
+	"source":   source,
+	".":        source,
+	"alias":    alias,
+	"unalias":  unalias,
+	"local":    local,
+	"return":   returnCmd,
+	"break":    breakCmd,
+	"continue": continueCmd,
+	":":        colon,
+	"shopt":    shopt,
+	"let":      let,
+	"declare":  declare,
+	"typeset":  declare,
 }
 
 func init() {
-	typeCmd = func(_ io.Reader, out io.Writer, args []string, _ *term.State, _ *[]string) error {
-		cmd := strings.Join(args, "")
-		_, ok := builtInCommandMap[cmd]
-		if !ok {
-			path := getCommandDirectoryAsync(cmd)
-			if path != "" {
-				fmt.Fprintf(out, "%s is %s\n", cmd, path)
-				return nil
+	typeCmd = func(_ io.Reader, out io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+		status := 0
+		for _, cmd := range args {
+			if value, ok := menu.aliases[cmd]; ok {
+				fmt.Fprintf(out, "%s is aliased to `%s'\n", cmd, value)
+				continue
 			}
-			fmt.Fprintf(out, "%s: not found\n", cmd)
-			return nil
+			if f, ok := menu.functions[cmd]; ok {
+				fmt.Fprintf(out, "%s is a function\n%s\n", cmd, f)
+				continue
+			}
+			_, ok := builtInCommandMap[cmd]
+			if !ok {
+				path := getCommandDirectoryAsync(cmd)
+				if path != "" {
+					fmt.Fprintf(out, "%s is %s\n", cmd, path)
+					continue
+				}
+				fmt.Fprintf(errOut, "%s: not found\n", cmd)
+				status = 1
+				continue
+			}
+			fmt.Fprintf(out, "%s is a shell builtin\n", cmd)
+		}
+		if status != 0 {
+			return exitStatus(status)
 		}
-		fmt.Fprintf(out, "%s is a shell builtin\n", cmd)
 		return nil
 	}
 	builtInCommandMap["type"] = typeCmd
 }
 
-func newBuiltInMenu() *builtInMenu {
+func newBuiltInMenu(interactive bool) *builtInMenu {
 	return &builtInMenu{
-		commands:   builtInCommandMap,
-		prefixTrie: getCommandsTrie(builtInCommandMap),
-		history:    []string{},
+		commands:    builtInCommandMap,
+		history:     []string{},
+		vars:        newVariableStore(),
+		aliases:     map[string]string{},
+		functions:   map[string]*functionDefinition{},
+		jobs:        newJobTable(interactive),
+		interactive: interactive,
+	}
+}
+
+// completionTrie returns the names TAB completes: builtins, aliases and the
+// commands on PATH. Only the line editor completes, so PATH is not scanned
+// until the first completion, which keeps non-interactive shells and
+// subshells from paying for it.
+func (bM *builtInMenu) completionTrie() *trieNode {
+	if bM.prefixTrie == nil {
+		bM.prefixTrie = getCommandsTrie(bM.commands)
+		for name := range bM.aliases {
+			bM.prefixTrie.insert(name)
+		}
 	}
+	return bM.prefixTrie
+}
+
+// exitStatus is returned by builtins that finish normally with a non-zero
+// status, as opposed to errors that mean the builtin itself broke.
+type exitStatus int
+
+func (e exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
 }
 
-func exit(_ io.Reader, _ io.Writer, args []string, termState *term.State, hList *[]string) error {
+func exit(_ io.Reader, _ io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	status := menu.vars.lastStatus
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(errOut, "exit: %s: numeric argument required\n", args[0])
+			n = 2
+		}
+		status = n & 0xff
+	}
+
+	hList := &menu.history
 	historyPath := os.Getenv("HISTFILE")
-	if historyPath != "" {
+	if historyPath != "" && menu.interactive {
 		var buf bytes.Buffer
 		err := readContentFromFile(&buf, historyPath)
 		if err != nil {
@@ -84,31 +335,33 @@ func exit(_ io.Reader, _ io.Writer, args []string, termState *term.State, hList
 			}
 
 			filteredList := currentHistory[startIndex:]
-			err := manageHistory(appendMode, termState, &filteredList)
+			err := manageHistory(appendMode, &filteredList)
 			if err != nil {
 				return err
 			}
 		} else {
-			err := manageHistory(writeMode, termState, hList)
+			err := manageHistory(writeMode, hList)
 			if err != nil {
 				return err
 			}
 		}
 	}
 	
-	fmt.Printf("\r\n")
-	term.Restore(int(os.Stdin.Fd()), termState)
-	os.Exit(0)
+	if menu.interactive {
+		fmt.Fprintln(os.Stderr, "exit")
+		term.Restore(int(os.Stdin.Fd()), menu.termState)
+	}
+	os.Exit(status)
 
 	return nil
 }
 
-func echo(_ io.Reader, out io.Writer, args []string, _ *term.State, _ *[]string) error {
-	fmt.Fprintln(out, strings.Trim(strings.Join(args, ""), " "))
+func echo(_ io.Reader, out io.Writer, _ io.Writer, args []string, _ *builtInMenu) error {
+	fmt.Fprintln(out, strings.Join(args, " "))
 	return nil
 }
 
-func pwd(_ io.Reader, out io.Writer, args []string, _ *term.State, _ *[]string) error {
+func pwd(_ io.Reader, out io.Writer, _ io.Writer, args []string, _ *builtInMenu) error {
 	currentDir, err := os.Getwd()
 	if err != nil {
 		return errors.New("error finding path")
@@ -117,103 +370,57 @@ func pwd(_ io.Reader, out io.Writer, args []string, _ *term.State, _ *[]string)
 	return nil
 }
 
-func cd(_ io.Reader, out io.Writer, args []string, termState *term.State, _ *[]string) error {
-	path := strings.Join(args, "")
+func cd(_ io.Reader, _ io.Writer, errOut io.Writer, args []string, _ *builtInMenu) error {
+	path := "~"
+	if len(args) > 0 {
+		path = args[0]
+	}
 	if path == "~" {
 		homeDir, err := os.UserHomeDir()
 		if err != nil {
-			term.Restore(int(os.Stdin.Fd()), termState)
 			return errors.New("error finding home directory")
 		}
 		err = os.Chdir(homeDir)
 		if err != nil {
-			term.Restore(int(os.Stdin.Fd()), termState)
 			return errors.New("error changing to home directory")
 		}
 		return nil
 	}
 	_, err := os.Stat(path)
 	if err != nil {
-		fmt.Fprintf(out, "cd: %s: No such file or directory\n", path)
-		return nil
+		fmt.Fprintf(errOut, "cd: %s: No such file or directory\n", path)
+		return exitStatus(1)
 	}
 	err = os.Chdir(path)
 	if err != nil {
-		term.Restore(int(os.Stdin.Fd()), termState)
 		return errors.New("error changing path")
 	}
 	return nil
 }
 
-func history(_ io.Reader, out io.Writer, args []string, _ *term.State, hList *[]string) error {
+func history(_ io.Reader, out io.Writer, _ io.Writer, args []string, menu *builtInMenu) error {
 	var historyOutput string
+	hList := &menu.history
 	existingHistory := *hList
 	totalArgs := len(args)
 	if totalArgs > 0 {
 		first := args[0]
 		switch first {
 		case "-r":
-			if totalArgs < 1 {
+			if totalArgs < 2 {
 				return errors.New("path is required")
 			}
-			cleanedParams := filterSpacesFromParams(args)
-			path := cleanedParams[1]
-			var buffer bytes.Buffer
-			err := readContentFromFile(&buffer, path)
-			if err != nil {
-				return err
-			}
-			entries := strings.Split(buffer.String(), "\n")
-			for _, e := range entries {
-				if len(e) > 0 {
-					*hList = append(*hList, e)
-				}
-			}
-			return nil
+			return readHistoryFile(args[1], hList)
 		case "-w":
-			if totalArgs < 1 {
+			if totalArgs < 2 {
 				return errors.New("path is required")
 			}
-			cleanedParams := filterSpacesFromParams(args)
-			path := cleanedParams[1]
-			for _, e := range existingHistory {
-				historyOutput += fmt.Sprintf("%s\n", e)
-			}
-			err := writeContentTofile([]byte(historyOutput), path)
-			if err != nil {
-				return err
-			}
-			return nil
+			return writeHistoryFile(args[1], existingHistory)
 		case "-a":
-			if totalArgs < 1 {
+			if totalArgs < 2 {
 				return errors.New("path is required")
 			}
-			cleanedParams := filterSpacesFromParams(args)
-			path := cleanedParams[1]
-			hasAppended := false
-			appendedIndex := 0
-			for i, e := range existingHistory {
-				if strings.Contains(e, "history -a") && i != len(existingHistory) - 1 {
-					hasAppended = true
-					appendedIndex = i 
-				}
-			}
-
-			startIndex := 0
-			if hasAppended && appendedIndex + 1 < len(existingHistory) {
-				startIndex = appendedIndex + 1
-			}
-
-			for startIndex < len(existingHistory) {
-				entrie := existingHistory[startIndex]
-				historyOutput += fmt.Sprintf("%s\n", entrie)
-				startIndex++
-			}
-			err := appendContentToFile(historyOutput, path)
-			if err != nil {
-				return err
-			}
-			return nil
+			return appendHistoryFile(args[1], existingHistory)
 		}
 	}
 
@@ -228,9 +435,921 @@ func history(_ io.Reader, out io.Writer, args []string, _ *term.State, hList *[]
 		}
 
 		for _, row := range currentHistory {
-			historyOutput += fmt.Sprintf("\t%d %s\r\n", row.order, row.value)
+			historyOutput += fmt.Sprintf("\t%d %s\n", row.order, row.value)
 		}
 		fmt.Fprint(out, historyOutput)
 	}
 	return nil
 }
+
+func readHistoryFile(path string, hList *[]string) error {
+	var buffer bytes.Buffer
+	err := readContentFromFile(&buffer, path)
+	if err != nil {
+		return err
+	}
+	entries := strings.Split(buffer.String(), "\n")
+	for _, e := range entries {
+		if len(e) > 0 {
+			*hList = append(*hList, e)
+		}
+	}
+	return nil
+}
+
+func writeHistoryFile(path string, existingHistory []string) error {
+	var historyOutput string
+	for _, e := range existingHistory {
+		historyOutput += fmt.Sprintf("%s\n", e)
+	}
+	return writeContentTofile([]byte(historyOutput), path)
+}
+
+func appendHistoryFile(path string, existingHistory []string) error {
+	var historyOutput string
+	hasAppended := false
+	appendedIndex := 0
+	for i, e := range existingHistory {
+		if strings.Contains(e, "history -a") && i != len(existingHistory) - 1 {
+			hasAppended = true
+			appendedIndex = i 
+		}
+	}
+
+	startIndex := 0
+	if hasAppended && appendedIndex + 1 < len(existingHistory) {
+		startIndex = appendedIndex + 1
+	}
+
+	for startIndex < len(existingHistory) {
+		entrie := existingHistory[startIndex]
+		historyOutput += fmt.Sprintf("%s\n", entrie)
+		startIndex++
+	}
+	return appendContentToFile(historyOutput, path)
+}
+
+func export(_ io.Reader, out io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	names := args
+	unexport := false
+	if len(names) > 0 && (names[0] == "-n" || names[0] == "-p") {
+		unexport = names[0] == "-n"
+		names = names[1:]
+	}
+	if len(names) == 0 {
+		printVariables(out, menu.vars, "-x")
+		return nil
+	}
+
+	status := 0
+	for _, arg := range names {
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !isValidName(name) {
+			fmt.Fprintf(errOut, "export: `%s': not a valid identifier\n", arg)
+			status = 1
+			continue
+		}
+		if hasValue {
+			if err := menu.vars.set(name, value); err != nil {
+				fmt.Fprintf(errOut, "export: %s\n", err)
+				status = 1
+				continue
+			}
+		}
+		if unexport {
+			menu.vars.unexport(name)
+			continue
+		}
+		menu.vars.export(name)
+	}
+	if status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
+
+func readonly(_ io.Reader, out io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	names := args
+	if len(names) > 0 && names[0] == "-p" {
+		names = names[1:]
+	}
+	if len(names) == 0 {
+		printVariables(out, menu.vars, "-r")
+		return nil
+	}
+
+	status := 0
+	for _, arg := range names {
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !isValidName(name) {
+			fmt.Fprintf(errOut, "readonly: `%s': not a valid identifier\n", arg)
+			status = 1
+			continue
+		}
+		if hasValue {
+			if err := menu.vars.set(name, value); err != nil {
+				fmt.Fprintf(errOut, "readonly: %s\n", err)
+				status = 1
+				continue
+			}
+		}
+		menu.vars.markReadonly(name)
+	}
+	if status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
+
+func unset(_ io.Reader, _ io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	names := args
+	if len(names) > 0 && names[0] == "-f" {
+		for _, name := range names[1:] {
+			delete(menu.functions, name)
+		}
+		return nil
+	}
+	if len(names) > 0 && names[0] == "-v" {
+		names = names[1:]
+	}
+	status := 0
+	for _, name := range names {
+		if base, subscript, ok := splitElement(name); ok && isValidName(base) {
+			if err := menu.vars.unsetElement(base, subscript); err != nil {
+				fmt.Fprintf(errOut, "unset: %s\n", err)
+				status = 1
+			}
+			continue
+		}
+		if err := menu.vars.unset(name); err != nil {
+			fmt.Fprintf(errOut, "unset: %s\n", err)
+			status = 1
+		}
+	}
+	if status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
+
+// env prints the exported environment, or runs a command with a modified
+// copy of it when one is given after the NAME=value arguments.
+func env(in io.Reader, out io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	params := args
+	environment := menu.vars.environ()
+
+	for len(params) > 0 {
+		p := params[0]
+		if p == "-i" || p == "-" {
+			environment = []string{}
+			params = params[1:]
+			continue
+		}
+		if p == "-u" && len(params) > 1 {
+			environment = removeFromEnviron(environment, params[1])
+			params = params[2:]
+			continue
+		}
+		name, _, ok := strings.Cut(p, "=")
+		if !ok || name == "" {
+			break
+		}
+		environment = append(removeFromEnviron(environment, name), p)
+		params = params[1:]
+	}
+
+	if len(params) == 0 {
+		for _, e := range environment {
+			fmt.Fprintln(out, e)
+		}
+		return nil
+	}
+
+	c := newExternalCmd(params[0], params[1:], environment)
+	c.setFiles(fdTableOf(in, out, errOut))
+	err := c.run()
+	if err != nil && !isExitError(err) {
+		fmt.Fprintf(errOut, "env: %s: No such file or directory\n", params[0])
+		return exitStatus(127)
+	}
+	if status := statusFromError(err); status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
+
+func alias(_ io.Reader, out io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	if len(args) > 0 && args[0] == "-p" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		names := make([]string, 0, len(menu.aliases))
+		for name := range menu.aliases {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			fmt.Fprintf(out, "alias %s=%s\n", name, singleQuote(menu.aliases[name]))
+		}
+		return nil
+	}
+
+	status := 0
+	for _, arg := range args {
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !hasValue {
+			if value, ok := menu.aliases[name]; ok {
+				fmt.Fprintf(out, "alias %s=%s\n", name, singleQuote(value))
+				continue
+			}
+			fmt.Fprintf(errOut, "alias: %s: not found\n", name)
+			status = 1
+			continue
+		}
+		if name == "" || strings.ContainsAny(name, "/$`'\"\\ \t") {
+			fmt.Fprintf(errOut, "alias: `%s': invalid alias name\n", name)
+			status = 1
+			continue
+		}
+		menu.aliases[name] = value
+		if menu.prefixTrie != nil {
+			menu.prefixTrie.insert(name)
+		}
+	}
+	if status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
+
+func unalias(_ io.Reader, _ io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	if len(args) == 0 {
+		fmt.Fprintln(errOut, "unalias: usage: unalias [-a] name [name ...]")
+		return exitStatus(2)
+	}
+	names := args
+	if args[0] == "-a" {
+		names = []string{}
+		for name := range menu.aliases {
+			names = append(names, name)
+		}
+	}
+
+	status := 0
+	for _, name := range names {
+		if _, ok := menu.aliases[name]; !ok {
+			fmt.Fprintf(errOut, "unalias: %s: not found\n", name)
+			status = 1
+			continue
+		}
+		delete(menu.aliases, name)
+		// Keep completing the name if it is still a command of its own.
+		if menu.prefixTrie != nil && !menu.isBuiltIn(name) && getCommandDirectoryAsync(name) == "" {
+			menu.prefixTrie.remove(name)
+		}
+	}
+	if status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
+
+// singleQuote quotes s so the shell reads it back as the same word.
+func singleQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// source runs the commands of a file in the current shell, so the variables
+// and directory it sets stay in effect. Extra arguments become the positional
+// parameters while the file runs.
+func source(in io.Reader, out io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	if len(args) == 0 {
+		fmt.Fprintln(errOut, "source: filename argument required")
+		fmt.Fprintln(errOut, "source: usage: source filename [arguments]")
+		return exitStatus(2)
+	}
+	f, err := os.Open(findSourceFile(args[0]))
+	if err != nil {
+		fmt.Fprintf(errOut, "source: %s\n", describeOpenError(err))
+		return exitStatus(1)
+	}
+	defer f.Close()
+
+	if len(args) > 1 {
+		saved := menu.vars.positional
+		menu.vars.positional = args[1:]
+		defer func() { menu.vars.positional = saved }()
+	}
+	menu.sourcing++
+	status := runScript(f, args[0], 1, menu, fdTableOf(in, out, errOut))
+	menu.sourcing--
+	menu.returning = false
+	if status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
+
+// functionBuiltin runs a shell function the way a builtin runs, so it can
+// be a stage of a pipeline. The arguments become the positional parameters
+// for the duration of the call.
+func functionBuiltin(f *functionDefinition) builtin {
+	return func(in io.Reader, out io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+		menu.vars.pushScope(args)
+		saved := menu.location
+		menu.location = f.defined
+		status := runCompound(f.body, menu, fdTableOf(in, out, errOut))
+		menu.location = saved
+		menu.vars.popScope()
+		menu.returning = false
+		if status != 0 {
+			return exitStatus(status)
+		}
+		return nil
+	}
+}
+
+func local(_ io.Reader, out io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	if len(menu.vars.scopes) == 0 {
+		fmt.Fprintln(errOut, "local: can only be used in a function")
+		return exitStatus(1)
+	}
+	return declareVariables("local", out, errOut, args, menu)
+}
+
+// declare sets variables and their attributes, or shows them the way they
+// could be declared again. Inside a function it declares local variables
+// unless -g is given.
+func declare(_ io.Reader, out io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	return declareVariables("declare", out, errOut, args, menu)
+}
+
+// declareVariables implements declare, typeset and local, which differ
+// only in the name they report errors under. A value written as ( ... ) is
+// a list of array elements.
+func declareVariables(cmdName string, out io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	flags := map[rune]bool{}
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		if args[0] == "--" {
+			args = args[1:]
+			break
+		}
+		for _, flag := range args[0][1:] {
+			switch flag {
+			case 'a', 'A', 'x', 'r', 'p', 'g':
+				flags[flag] = true
+			default:
+				fmt.Fprintf(errOut, "%s: -%c: invalid option\n", cmdName, flag)
+				fmt.Fprintf(errOut, "%s: usage: %s [-aAgprx] [name[=value] ...]\n", cmdName, cmdName)
+				return exitStatus(2)
+			}
+		}
+		args = args[1:]
+	}
+	if flags['a'] && flags['A'] {
+		fmt.Fprintf(errOut, "%s: cannot use `-a' and `-A' together\n", cmdName)
+		return exitStatus(1)
+	}
+
+	if len(args) == 0 {
+		for _, name := range menu.vars.sortedNames() {
+			v := menu.vars.values[name]
+			if (flags['a'] && v.indexed == nil) || (flags['A'] && v.assoc == nil) ||
+				(flags['x'] && !v.exported) || (flags['r'] && !v.readonly) {
+				continue
+			}
+			fmt.Fprintln(out, menu.vars.declaration(name, strconv.Quote))
+		}
+		return nil
+	}
+
+	status := 0
+	for _, arg := range args {
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !isValidName(name) {
+			fmt.Fprintf(errOut, "%s: `%s': not a valid identifier\n", cmdName, arg)
+			status = 1
+			continue
+		}
+		if flags['p'] {
+			if _, ok := menu.vars.values[name]; !ok {
+				fmt.Fprintf(errOut, "%s: %s: not found\n", cmdName, name)
+				status = 1
+				continue
+			}
+			fmt.Fprintln(out, menu.vars.declaration(name, strconv.Quote))
+			continue
+		}
+		if err := declareVariable(name, value, hasValue, flags, menu); err != nil {
+			fmt.Fprintf(errOut, "%s: %s\n", cmdName, err)
+			status = 1
+		}
+	}
+	if status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
+
+func declareVariable(name string, value string, hasValue bool, flags map[rune]bool, menu *builtInMenu) error {
+	if len(menu.vars.scopes) > 0 && !flags['g'] {
+		if err := menu.vars.makeLocal(name); err != nil {
+			return err
+		}
+	}
+	if flags['a'] || flags['A'] {
+		if err := menu.vars.declareArray(name, flags['A']); err != nil {
+			return err
+		}
+	}
+	switch {
+	case hasValue && strings.HasPrefix(value, "(") && strings.HasSuffix(value, ")"):
+		elements, err := parseArrayText(value)
+		if err != nil {
+			return err
+		}
+		entries, err := expandArrayElements(elements, menu)
+		if err != nil {
+			return err
+		}
+		if err := menu.vars.assignArray(name, entries); err != nil {
+			return err
+		}
+	case hasValue:
+		if err := menu.vars.set(name, value); err != nil {
+			return err
+		}
+	}
+	if flags['x'] {
+		menu.vars.export(name)
+	}
+	if flags['r'] {
+		menu.vars.markReadonly(name)
+	}
+	return nil
+}
+
+// returnCmd ends the function or sourced file being run with the given
+// status, or the status of the last command.
+func returnCmd(_ io.Reader, _ io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	if len(menu.vars.scopes) == 0 && menu.sourcing == 0 {
+		fmt.Fprintln(errOut, "return: can only `return' from a function or sourced script")
+		return exitStatus(1)
+	}
+	status := menu.vars.lastStatus
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(errOut, "return: %s: numeric argument required\n", args[0])
+			n = 2
+		}
+		status = n & 0xff
+	}
+	menu.returning = true
+	if status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
+
+// shellOptions are the options shopt knows about.
+var shellOptions = []string{"dotglob", "failglob", "globstar", "nullglob"}
+
+// shopt sets (-s) or unsets (-u) shell options. Without either it prints
+// them, or with -q only reports through its status whether they are all
+// set.
+func shopt(_ io.Reader, out io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	mode := ""
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		for _, flag := range args[0][1:] {
+			switch flag {
+			case 's', 'u', 'p', 'q':
+				if (mode == "s" && flag == 'u') || (mode == "u" && flag == 's') {
+					fmt.Fprintln(errOut, "shopt: cannot set and unset shell options simultaneously")
+					return exitStatus(1)
+				}
+				if mode == "" || flag == 's' || flag == 'u' {
+					mode = string(flag)
+				}
+			default:
+				fmt.Fprintf(errOut, "shopt: -%c: invalid option\n", flag)
+				fmt.Fprintln(errOut, "shopt: usage: shopt [-pqsu] [optname ...]")
+				return exitStatus(2)
+			}
+		}
+		args = args[1:]
+	}
+
+	names := args
+	if len(names) == 0 {
+		if mode == "s" || mode == "u" {
+			// Like bash, shopt -s alone lists the options that are set.
+			for _, name := range shellOptions {
+				if menu.vars.options[name] == (mode == "s") {
+					fmt.Fprintf(out, "%-15s\t%s\n", name, onOff(menu.vars.options[name]))
+				}
+			}
+			return nil
+		}
+		names = shellOptions
+	}
+
+	status := 0
+	for _, name := range names {
+		if !slices.Contains(shellOptions, name) {
+			fmt.Fprintf(errOut, "shopt: %s: invalid shell option name\n", name)
+			status = 1
+			continue
+		}
+		switch mode {
+		case "s", "u":
+			menu.vars.options[name] = mode == "s"
+		case "q":
+			if !menu.vars.options[name] {
+				status = 1
+			}
+		case "p":
+			flag := "-u"
+			if menu.vars.options[name] {
+				flag = "-s"
+			}
+			fmt.Fprintf(out, "shopt %s %s\n", flag, name)
+		default:
+			fmt.Fprintf(out, "%-15s\t%s\n", name, onOff(menu.vars.options[name]))
+			if !menu.vars.options[name] && len(args) > 0 {
+				status = 1
+			}
+		}
+	}
+	if status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// colon is the : builtin, which does nothing and succeeds.
+func colon(_ io.Reader, _ io.Writer, _ io.Writer, _ []string, _ *builtInMenu) error {
+	return nil
+}
+
+// let evaluates each argument as an arithmetic expression and succeeds when
+// the last one is not zero.
+func let(_ io.Reader, _ io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	if len(args) == 0 {
+		fmt.Fprintln(errOut, "let: expression expected")
+		return exitStatus(1)
+	}
+	var value int64
+	for _, arg := range args {
+		var err error
+		if value, err = evaluateArithmetic(arg, menu.vars); err != nil {
+			fmt.Fprintf(errOut, "let: %s\n", err)
+			return exitStatus(1)
+		}
+	}
+	if value == 0 {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+func breakCmd(_ io.Reader, _ io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	n, err := loopCount("break", errOut, args, menu)
+	menu.breaks = n
+	return err
+}
+
+func continueCmd(_ io.Reader, _ io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	n, err := loopCount("continue", errOut, args, menu)
+	menu.continues = n
+	return err
+}
+
+// loopCount reads the number of enclosing loops break or continue applies
+// to, at most the number of loops being run.
+func loopCount(name string, errOut io.Writer, args []string, menu *builtInMenu) (int, error) {
+	if menu.loops == 0 {
+		fmt.Fprintf(errOut, "%s: only meaningful in a `for', `while', or `until' loop\n", name)
+		return 0, nil
+	}
+	n := 1
+	if len(args) > 0 {
+		var err error
+		n, err = strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(errOut, "%s: %s: numeric argument required\n", name, args[0])
+			return menu.loops, exitStatus(128)
+		}
+		if n < 1 {
+			fmt.Fprintf(errOut, "%s: %d: loop count out of range\n", name, n)
+			return menu.loops, exitStatus(1)
+		}
+	}
+	return min(n, menu.loops), nil
+}
+
+// findSourceFile looks a name without a slash up in PATH first and falls
+// back to the current directory, the way bash does for source.
+func findSourceFile(name string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		candidate := filepath.Join(dir, name)
+		if info, err := os.Stat(candidate); err == nil && info.Mode().IsRegular() {
+			return candidate
+		}
+	}
+	return name
+}
+
+func jobs(_ io.Reader, out io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	long, pidsOnly := false, false
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		for _, flag := range args[0][1:] {
+			switch flag {
+			case 'l':
+				long = true
+			case 'p':
+				pidsOnly = true
+			default:
+				fmt.Fprintf(errOut, "jobs: -%c: invalid option\n", flag)
+				return exitStatus(2)
+			}
+		}
+		args = args[1:]
+	}
+
+	status := 0
+	selected := menu.jobs.snapshot()
+	if len(args) > 0 {
+		selected = nil
+		for _, spec := range args {
+			j, err := menu.jobs.find(spec)
+			if err != nil {
+				fmt.Fprintf(errOut, "jobs: %s\n", err)
+				status = 1
+				continue
+			}
+			selected = append(selected, j)
+		}
+	}
+	for _, j := range selected {
+		switch {
+		case pidsOnly:
+			fmt.Fprintln(out, j.lastPid())
+		case long:
+			fmt.Fprintln(out, menu.jobs.longLine(j))
+		default:
+			fmt.Fprintln(out, menu.jobs.line(j))
+		}
+	}
+	menu.jobs.forgetDone(selected)
+	if status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
+
+func fg(_ io.Reader, out io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	spec := ""
+	if len(args) > 0 {
+		spec = args[0]
+	}
+	j, err := menu.jobs.find(spec)
+	if err != nil {
+		fmt.Fprintf(errOut, "fg: %s\n", err)
+		return exitStatus(1)
+	}
+
+	fmt.Fprintln(out, j.command)
+	menu.jobs.resume(j, true)
+	status, stopped := menu.jobs.waitForeground(j)
+	menu.jobs.reclaimTerminal()
+	menu.jobs.reportForeground(out, j, stopped)
+	if status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
+
+func bg(_ io.Reader, out io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	status := 0
+	for _, spec := range args {
+		j, err := menu.jobs.find(spec)
+		if err != nil {
+			fmt.Fprintf(errOut, "bg: %s\n", err)
+			status = 1
+			continue
+		}
+		if !menu.jobs.isStopped(j) {
+			fmt.Fprintf(errOut, "bg: job %d already in background\n", j.id)
+			continue
+		}
+		menu.jobs.resume(j, false)
+		fmt.Fprintf(out, "[%d]%s %s &\n", j.id, menu.jobs.markOf(j), j.command)
+	}
+	if status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
+
+func wait(_ io.Reader, _ io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	if len(args) == 0 {
+		if status := menu.jobs.wait(menu.jobs.snapshot()); status > 128 {
+			return exitStatus(status)
+		}
+		return nil
+	}
+
+	status := 0
+	for _, arg := range args {
+		var j *job
+		if strings.HasPrefix(arg, "%") {
+			found, err := menu.jobs.find(arg)
+			if err != nil {
+				fmt.Fprintf(errOut, "wait: %s\n", err)
+				status = 127
+				continue
+			}
+			j = found
+		} else {
+			pid, err := strconv.Atoi(arg)
+			if err != nil {
+				fmt.Fprintf(errOut, "wait: `%s': not a pid or valid job spec\n", arg)
+				status = 2
+				continue
+			}
+			if j = menu.jobs.byPid(pid); j == nil {
+				fmt.Fprintf(errOut, "wait: pid %d is not a child of this shell\n", pid)
+				status = 127
+				continue
+			}
+		}
+		status = menu.jobs.wait([]*job{j})
+	}
+	if status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
+
+func disown(_ io.Reader, _ io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	all, runningOnly := false, false
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		for _, flag := range args[0][1:] {
+			switch flag {
+			case 'a':
+				all = true
+			case 'r':
+				runningOnly = true
+			default:
+				fmt.Fprintf(errOut, "disown: -%c: invalid option\n", flag)
+				return exitStatus(2)
+			}
+		}
+		args = args[1:]
+	}
+
+	status := 0
+	selected := []*job{}
+	switch {
+	case all || runningOnly:
+		for _, j := range menu.jobs.snapshot() {
+			if runningOnly && menu.jobs.isStopped(j) {
+				continue
+			}
+			selected = append(selected, j)
+		}
+	case len(args) == 0:
+		args = []string{""}
+	}
+	for _, spec := range args {
+		j, err := menu.jobs.find(spec)
+		if err != nil {
+			fmt.Fprintf(errOut, "disown: %s\n", err)
+			status = 1
+			continue
+		}
+		selected = append(selected, j)
+	}
+	menu.jobs.forget(selected)
+	if status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
+
+func kill(_ io.Reader, out io.Writer, errOut io.Writer, args []string, menu *builtInMenu) error {
+	if len(args) > 0 && args[0] == "-l" {
+		return listSignals(out, errOut, args[1:])
+	}
+
+	sig := syscall.SIGTERM
+	if len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' && args[0] != "--" {
+		spec := args[0][1:]
+		args = args[1:]
+		if spec == "s" || spec == "n" {
+			if len(args) == 0 {
+				fmt.Fprintf(errOut, "kill: -%s: option requires an argument\n", spec)
+				return exitStatus(2)
+			}
+			spec = args[0]
+			args = args[1:]
+		}
+		parsed, ok := parseSignal(spec)
+		if !ok {
+			fmt.Fprintf(errOut, "kill: %s: invalid signal specification\n", spec)
+			return exitStatus(1)
+		}
+		sig = parsed
+	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(errOut, "kill: usage: kill [-s sigspec | -n signum | -sigspec] pid | jobspec ... or kill -l [sigspec]")
+		return exitStatus(2)
+	}
+
+	status := 0
+	for _, target := range args {
+		if strings.HasPrefix(target, "%") {
+			j, err := menu.jobs.find(target)
+			if err != nil {
+				fmt.Fprintf(errOut, "kill: %s\n", err)
+				status = 1
+				continue
+			}
+			if pid, err := menu.jobs.signal(j, sig); err != nil {
+				fmt.Fprintf(errOut, "kill: (%d) - %s\n", pid, capitalize(err.Error()))
+				status = 1
+			}
+			continue
+		}
+		pid, err := strconv.Atoi(target)
+		if err != nil {
+			fmt.Fprintf(errOut, "kill: %s: arguments must be process or job IDs\n", target)
+			status = 1
+			continue
+		}
+		if err := syscall.Kill(pid, sig); err != nil {
+			fmt.Fprintf(errOut, "kill: (%d) - %s\n", pid, capitalize(err.Error()))
+			status = 1
+		}
+	}
+	if status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
+
+// listSignals implements kill -l: the whole table without arguments, or the
+// name of every signal number given, where 128+n stands for signal n.
+func listSignals(out io.Writer, errOut io.Writer, args []string) error {
+	if len(args) == 0 {
+		signals := []int{}
+		for _, sig := range signalNames {
+			signals = append(signals, int(sig))
+		}
+		slices.Sort(signals)
+		for _, n := range signals {
+			fmt.Fprintf(out, "%2d) SIG%s\n", n, signalName(syscall.Signal(n)))
+		}
+		return nil
+	}
+
+	status := 0
+	for _, arg := range args {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			sig, ok := parseSignal(arg)
+			if !ok {
+				fmt.Fprintf(errOut, "kill: %s: invalid signal specification\n", arg)
+				status = 1
+				continue
+			}
+			fmt.Fprintln(out, int(sig))
+			continue
+		}
+		if n > 128 {
+			n -= 128
+		}
+		fmt.Fprintln(out, signalName(syscall.Signal(n)))
+	}
+	if status != 0 {
+		return exitStatus(status)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"syscall"
+)
+
+// compoundBuiltin runs a compound command the way a builtin runs, so it can
+// be a stage of a pipeline.
+func compoundBuiltin(node compoundNode) builtin {
+	return func(in io.Reader, out io.Writer, errOut io.Writer, _ []string, menu *builtInMenu) error {
+		if status := runCompound(node, menu, fdTableOf(in, out, errOut)); status != 0 {
+			return exitStatus(status)
+		}
+		return nil
+	}
+}
+
+// runCompound runs a compound command inside the shell and returns its
+// status. A subshell is the exception: it is started as a job of its own.
+func runCompound(node compoundNode, menu *builtInMenu, base fdTable) int {
+	if s, ok := node.(*subshell); ok {
+		return runPipeline(pipelineOf(s, "("+s.source+")"), menu, base)
+	}
+
+	fds, opened, err := applyRedirections(node.redirects(), base, menu)
+	if err != nil {
+		reportExpansionError(base[2], err, menu)
+		return 1
+	}
+	defer closeAll(opened)
+
+	switch n := node.(type) {
+	case *braceGroup:
+		return executeList(n.body, menu, fds)
+	case *ifCommand:
+		return runIf(n, menu, fds)
+	case *loop:
+		return runLoop(n, menu, fds)
+	case *forLoop:
+		return runFor(n, menu, fds)
+	case *caseCommand:
+		return runCase(n, menu, fds)
+	case *arithmeticCommand:
+		return runArithmetic(n, menu, fds)
+	}
+	return 0
+}
+
+func runIf(c *ifCommand, menu *builtInMenu, fds fdTable) int {
+	for _, clause := range c.clauses {
+		status := executeList(clause.condition, menu, fds)
+		if menu.unwinding() {
+			return status
+		}
+		if status == 0 {
+			return executeList(clause.body, menu, fds)
+		}
+	}
+	if c.elseBody != nil {
+		return executeList(c.elseBody, menu, fds)
+	}
+	return 0
+}
+
+func runLoop(l *loop, menu *builtInMenu, fds fdTable) int {
+	menu.loops++
+	defer func() { menu.loops-- }()
+	interrupts := menu.jobs.interruptCount()
+	status := 0
+	for {
+		condition := executeList(l.condition, menu, fds)
+		if menu.endIteration(interrupts) {
+			break
+		}
+		if (condition == 0) == l.until {
+			break
+		}
+		status = executeList(l.body, menu, fds)
+		if menu.endIteration(interrupts) {
+			break
+		}
+	}
+	return interruptedStatus(menu, interrupts, status)
+}
+
+func runFor(f *forLoop, menu *builtInMenu, fds fdTable) int {
+	values := menu.vars.positional
+	if !f.positional {
+		var err error
+		if values, err = expandWords(f.words, menu); err != nil {
+			reportExpansionError(fds[2], err, menu)
+			return 1
+		}
+	}
+
+	menu.loops++
+	defer func() { menu.loops-- }()
+	interrupts := menu.jobs.interruptCount()
+	status := 0
+	for _, value := range values {
+		if err := menu.vars.set(f.name, value); err != nil {
+			menu.errorf(fds[2], "%s", err)
+			return 1
+		}
+		status = executeList(f.body, menu, fds)
+		if menu.endIteration(interrupts) {
+			break
+		}
+	}
+	return interruptedStatus(menu, interrupts, status)
+}
+
+// interruptedStatus is the status of a loop: 130 when an interrupt ended
+// it, status otherwise.
+func interruptedStatus(menu *builtInMenu, interrupts int, status int) int {
+	if menu.jobs.interruptCount() != interrupts {
+		return 128 + int(syscall.SIGINT)
+	}
+	return status
+}
+
+// runCase runs the list of the first item with a pattern matching the
+// subject. Quoted parts of a pattern match literally.
+func runCase(c *caseCommand, menu *builtInMenu, fds fdTable) int {
+	subject, err := expandWord(c.subject, menu)
+	if err != nil {
+		reportExpansionError(fds[2], err, menu)
+		return 1
+	}
+	for _, item := range c.items {
+		for _, p := range item.patterns {
+			pattern, err := expandPattern(p, menu)
+			if err != nil {
+				reportExpansionError(fds[2], err, menu)
+				return 1
+			}
+			if !matchPattern(pattern, subject) {
+				continue
+			}
+			if len(item.body.entries) == 0 {
+				return 0
+			}
+			return executeList(item.body, menu, fds)
+		}
+	}
+	return 0
+}
+
+// runArithmetic evaluates the expression of a (( )) command, which fails
+// when it is zero or cannot be evaluated.
+func runArithmetic(c *arithmeticCommand, menu *builtInMenu, fds fdTable) int {
+	value, err := arithmeticExpansion(c.expr, menu)
+	if err != nil {
+		// Unlike an arithmetic expansion, the command only fails.
+		var arithmetic *arithmeticError
+		if errors.As(err, &arithmetic) {
+			menu.errorf(fds[2], "((: %s", err)
+		} else {
+			printExpansionError(fds[2], err, menu)
+		}
+		return 1
+	}
+	if value == "0" {
+		return 1
+	}
+	return 0
+}
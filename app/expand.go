@@ -0,0 +1,385 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// expandWord resolves the parameter references, command substitutions and
+// arithmetic expansions of a word and joins its parts into the final string.
+// It is used where no field splitting or pathname expansion takes place,
+// like the value of an assignment.
+func expandWord(w word, menu *builtInMenu) (string, error) {
+	fields, err := expandWordFields(w, menu)
+	if err != nil {
+		return "", err
+	}
+	texts := make([]string, len(fields))
+	for i, f := range fields {
+		texts[i] = removeQuotes(f)
+	}
+	return strings.Join(texts, " "), nil
+}
+
+// arithmeticExpansion evaluates the expression of a $(( )) expansion after
+// expanding the parameters and command substitutions inside it.
+func arithmeticExpansion(expr string, menu *builtInMenu) (string, error) {
+	text, err := expandWord(tokenizeHeredoc(expr, false), menu)
+	if err != nil {
+		return "", err
+	}
+	value, err := evaluateArithmetic(text, menu.vars)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(value, 10), nil
+}
+
+// segment is a piece of a field along with the quoting it had. quoted text
+// came from quotes or a backslash and is taken literally. split text is the
+// result of an unquoted expansion, which field splitting breaks apart at the
+// characters of IFS. Any other text was written unquoted in the word.
+type segment struct {
+	text   string
+	quoted bool
+	split  bool
+}
+
+// field is a word in the middle of expansion. It keeps the segments it is
+// made of until quote removal, so the later phases know which characters
+// were quoted. keep is set once anything quoted went into the field, so
+// that it survives even when it is empty.
+type field struct {
+	segments []segment
+	keep     bool
+}
+
+func (f *field) add(text string, quoted bool) {
+	f.keep = f.keep || quoted
+	f.segments = append(f.segments, segment{text: text, quoted: quoted})
+}
+
+// addSplit appends the result of an unquoted expansion.
+func (f *field) addSplit(text string) {
+	f.segments = append(f.segments, segment{text: text, split: true})
+}
+
+// join appends another field to this one.
+func (f *field) join(other field) {
+	f.segments = append(f.segments, other.segments...)
+	f.keep = f.keep || other.keep
+}
+
+func (f field) isEmpty() bool {
+	for _, s := range f.segments {
+		if s.text != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// pattern is the field as a pattern, with the characters that were quoted
+// escaped. glob is set when the field has unquoted pattern characters,
+// which makes it subject to pathname expansion.
+func (f field) pattern() (pattern string, glob bool) {
+	for _, s := range f.segments {
+		if s.quoted {
+			pattern += escapePattern(s.text)
+			continue
+		}
+		pattern += s.text
+		glob = glob || strings.ContainsAny(s.text, "*?[")
+	}
+	return pattern, glob
+}
+
+// removeQuotes is the last phase of expansion: it drops what is left of
+// the quoting and returns the text of the field.
+func removeQuotes(f field) string {
+	text := ""
+	for _, s := range f.segments {
+		text += s.text
+	}
+	return text
+}
+
+// expandWordFields performs the expansions of a word, giving the fields it
+// stands for before field splitting. Only $@ and $*, and arrays like
+// ${arr[@]}, break a word apart at this point: into one field per value,
+// also when operators like ${@#pattern} apply to them.
+func expandWordFields(w word, menu *builtInMenu) ([]field, error) {
+	fields := []field{}
+	current := field{}
+	for _, t := range w.parts {
+		switch t.tType {
+		case VARIABLE:
+			values, err := expandParameter(t, menu)
+			if err != nil {
+				return nil, err
+			}
+			for i, v := range values {
+				if i > 0 {
+					fields = append(fields, current)
+					current = field{}
+				}
+				current.join(v)
+			}
+		case COMMANDSUB:
+			current.addExpansion(commandSubstitution(t.literal, menu), t.quoted)
+		case ARITHMETIC:
+			value, err := arithmeticExpansion(t.literal, menu)
+			if err != nil {
+				return nil, err
+			}
+			current.addExpansion(value, t.quoted)
+		default:
+			current.add(t.literal, t.quoted || t.tType == BACKWARD)
+		}
+	}
+	return append(fields, current), nil
+}
+
+// addExpansion appends the result of an expansion, which is split later
+// unless it was quoted.
+func (f *field) addExpansion(text string, quoted bool) {
+	if quoted {
+		f.add(text, true)
+		return
+	}
+	f.addSplit(text)
+}
+
+// splitFields performs field splitting. The results of unquoted expansions
+// are broken apart at the characters of ifs: a run of IFS whitespace
+// separates fields, and so does any other IFS character along with the
+// whitespace around it, even when that leaves an empty field. Fields that
+// end up empty are dropped unless something quoted went into them, so
+// unquoted expansions of empty values disappear while "" remains.
+func splitFields(fields []field, ifs string) []field {
+	result := []field{}
+	for _, f := range fields {
+		current := field{}
+		emit := func(always bool) {
+			if always || !current.isEmpty() || current.keep {
+				result = append(result, current)
+			}
+			current = field{}
+		}
+		for _, s := range f.segments {
+			if !s.split || ifs == "" {
+				current.segments = append(current.segments, s)
+				current.keep = current.keep || s.quoted
+				continue
+			}
+			text := s.text
+			for text != "" {
+				i := strings.IndexAny(text, ifs)
+				if i < 0 {
+					current.addSplit(text)
+					break
+				}
+				if i > 0 {
+					current.addSplit(text[:i])
+				}
+				end, hard := delimiterEnd(text, i, ifs)
+				emit(hard)
+				text = text[end:]
+			}
+		}
+		emit(false)
+	}
+	return result
+}
+
+// delimiterEnd reads the field delimiter that starts at text[i]: IFS
+// whitespace around at most one other IFS character. It returns where the
+// delimiter ends, and whether it had such a character.
+func delimiterEnd(text string, i int, ifs string) (int, bool) {
+	isWhite := func(c byte) bool {
+		return strings.IndexByte(" \t\n", c) >= 0 && strings.IndexByte(ifs, c) >= 0
+	}
+	for i < len(text) && isWhite(text[i]) {
+		i++
+	}
+	if i == len(text) || strings.IndexByte(ifs, text[i]) < 0 {
+		return i, false
+	}
+	i++
+	for i < len(text) && isWhite(text[i]) {
+		i++
+	}
+	return i, true
+}
+
+// expandPattern expands a word used as a pattern. The characters that came
+// from quotes or backslashes are escaped, so they only match themselves.
+func expandPattern(w word, menu *builtInMenu) (string, error) {
+	fields, err := expandWordFields(w, menu)
+	if err != nil {
+		return "", err
+	}
+	pattern := ""
+	for _, f := range fields {
+		p, _ := f.pattern()
+		pattern += p
+	}
+	return pattern, nil
+}
+
+func escapePattern(text string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		if strings.IndexByte(`*?[]\`, text[i]) >= 0 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(text[i])
+	}
+	return b.String()
+}
+
+// expandWords expands the words of a command into its arguments. The
+// expansions of each word are followed by field splitting, then pathname
+// expansion of the fields that are patterns, and finally quote removal.
+// What happens to a pattern that matches nothing depends on the nullglob
+// and failglob options, and by default it is kept as it is.
+func expandWords(words []word, menu *builtInMenu) ([]string, error) {
+	vars := menu.vars
+	expanded := make([]string, 0, len(words))
+	for _, w := range words {
+		fields, err := expandWordFields(w, menu)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range splitFields(fields, vars.fieldSeparators()) {
+			pattern, isGlob := f.pattern()
+			if !isGlob {
+				expanded = append(expanded, removeQuotes(f))
+				continue
+			}
+			matches := glob(pattern, vars.options)
+			switch {
+			case len(matches) > 0:
+				expanded = append(expanded, matches...)
+			case vars.options["failglob"]:
+				return nil, &noMatchError{pattern: removeQuotes(f)}
+			case !vars.options["nullglob"]:
+				expanded = append(expanded, removeQuotes(f))
+			}
+		}
+	}
+	return expanded, nil
+}
+
+// assignment is a prefix assignment of a command, such as the FOO=bar of
+// "FOO=bar cmd", with its value expanded.
+type assignment struct {
+	name  string
+	value string
+}
+
+func expandAssignments(nodes []assignmentNode, menu *builtInMenu) ([]assignment, error) {
+	assignments := make([]assignment, 0, len(nodes))
+	for _, a := range nodes {
+		value, err := expandWord(a.value, menu)
+		if err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, assignment{name: a.name, value: value})
+	}
+	return assignments, nil
+}
+
+// assignVariable performs an assignment of a command without words, to a
+// variable, an element of an array or a whole array.
+func assignVariable(a assignmentNode, menu *builtInMenu) error {
+	if a.array {
+		entries, err := expandArrayElements(a.elements, menu)
+		if err != nil {
+			return err
+		}
+		return menu.vars.assignArray(a.name, entries)
+	}
+	value, err := expandWord(a.value, menu)
+	if err != nil {
+		return err
+	}
+	if a.subscript == nil {
+		return menu.vars.set(a.name, value)
+	}
+	subscript, err := expandWord(*a.subscript, menu)
+	if err != nil {
+		return err
+	}
+	return menu.vars.setElement(a.name, subscript, value)
+}
+
+// expandArrayElements expands the elements of an array assignment. An
+// element without a key may expand into any number of elements, the way a
+// word expands into arguments.
+func expandArrayElements(elements []arrayElement, menu *builtInMenu) ([]arrayEntry, error) {
+	entries := []arrayEntry{}
+	for _, e := range elements {
+		if e.key == nil {
+			values, err := expandWords([]word{e.value}, menu)
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range values {
+				entries = append(entries, arrayEntry{value: v})
+			}
+			continue
+		}
+		key, err := expandWord(*e.key, menu)
+		if err != nil {
+			return nil, err
+		}
+		value, err := expandWord(e.value, menu)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, arrayEntry{key: key, keyed: true, value: value})
+	}
+	return entries, nil
+}
+
+// noMatchError is a pattern that matched nothing while failglob is set.
+type noMatchError struct {
+	pattern string
+}
+
+func (e *noMatchError) Error() string {
+	return "no match: " + e.pattern
+}
+
+// unsetParameterStatus is what a shell that is not interactive exits with
+// when ${var?} finds var unset, the same as bash.
+const unsetParameterStatus = 127
+
+// reportExpansionError prints why expanding the words or performing the
+// redirections of a command failed. As in bash, an arithmetic error, a
+// pattern failglob finds no match for, an assignment to a readonly variable
+// and ${var?} finding var unset abandon the rest of the command line. The
+// last makes a shell that is not interactive exit, as POSIX requires.
+func reportExpansionError(w io.Writer, err error, menu *builtInMenu) {
+	printExpansionError(w, err, menu)
+	var arithmetic *arithmeticError
+	var noMatch *noMatchError
+	var readonly *readonlyError
+	var unset *unsetParameterError
+	switch {
+	case errors.As(err, &unset) && !menu.interactive:
+		os.Exit(unsetParameterStatus)
+	case errors.As(err, &unset), errors.As(err, &arithmetic), errors.As(err, &noMatch), errors.As(err, &readonly):
+		menu.aborting = true
+	}
+}
+
+// printExpansionError prints why expanding or redirecting a command failed
+// without stopping anything else.
+func printExpansionError(w io.Writer, err error, menu *builtInMenu) {
+	menu.errorf(w, "%s", describeOpenError(err))
+}
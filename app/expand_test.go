@@ -0,0 +1,75 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// TestExpandWords checks the arguments that words expand into against what
+// bash gives for the same input and variables.
+func TestExpandWords(t *testing.T) {
+	tests := []struct {
+		name       string
+		ifs        *string
+		vars       map[string]string
+		positional []string
+		line       string
+		want       []string
+	}{
+		{name: "blanks between words", line: "echo a\tb   c", want: []string{"a", "b", "c"}},
+		{name: "quoted empty strings", line: `echo "" x '' a"" ""b`, want: []string{"", "x", "", "a", "b"}},
+		{name: "non-ASCII text", line: `echo é "ü" ö\ x`, want: []string{"é", "ü", "ö x"}},
+		{name: "unquoted expansion is split", vars: map[string]string{"x": " a  b "}, line: `echo $x "$x"`, want: []string{"a", "b", " a  b "}},
+		{name: "tabs and newlines split", vars: map[string]string{"x": "a\tb\nc"}, line: "echo $x", want: []string{"a", "b", "c"}},
+		{name: "empty expansions vanish", vars: map[string]string{"e": ""}, line: `echo $e "$e" x$e`, want: []string{"", "x"}},
+		{name: "split inside a word", vars: map[string]string{"x": " 1 2 "}, line: "echo pre${x}post", want: []string{"pre", "1", "2", "post"}},
+		{name: "quoted null before a split", vars: map[string]string{"x": " a"}, line: `echo ""$x`, want: []string{"", "a"}},
+		{name: "non-whitespace separators", ifs: ptr(":"), vars: map[string]string{"x": "a::b:"}, line: "echo $x", want: []string{"a", "", "b"}},
+		{name: "leading separator", ifs: ptr(":"), vars: map[string]string{"x": ":a"}, line: "echo $x", want: []string{"", "a"}},
+		{name: "mixed separators", ifs: ptr(" :"), vars: map[string]string{"x": " a : b :: c "}, line: "echo $x", want: []string{"a", "b", "", "c"}},
+		{name: "whitespace between separators", ifs: ptr(" :"), vars: map[string]string{"x": "a: :b"}, line: "echo $x", want: []string{"a", "", "b"}},
+		{name: "empty IFS", ifs: ptr(""), vars: map[string]string{"x": "a b"}, line: "echo $x", want: []string{"a b"}},
+		{name: "space-only IFS", ifs: ptr(" "), vars: map[string]string{"x": "a\tb c"}, line: "echo $x", want: []string{"a\tb", "c"}},
+		{name: "literal text is not split", ifs: ptr("x"), line: "echo axb ${u:-axb} $(echo axb)", want: []string{"axb", "a", "b", "a", "b"}},
+		{name: "command substitution", line: `echo $(echo "p  q") "$(echo "p  q")"`, want: []string{"p", "q", "p  q"}},
+		{name: "arithmetic", ifs: ptr("1"), line: "echo $((10+1)) $((10+100))", want: []string{"", "", "", "", "0"}},
+		{name: "default operand", line: `echo ${u:-a b} "${u:-a b}" ${u:-"a b"} ${u-""} "${u-}"`, want: []string{"a", "b", "a b", "a b", "", ""}},
+		{name: "positional parameters", positional: []string{"a b", "", "c"}, line: `echo $@ "$@" $* "$*"`, want: []string{"a", "b", "c", "a b", "", "c", "a", "b", "c", "a b  c"}},
+		{name: "$* joined by IFS", ifs: ptr("-"), positional: []string{"a b", "c"}, line: `echo "$*" $*`, want: []string{"a b-c", "a b", "c"}},
+		{name: "no positional parameters", line: `echo "$@" x`, want: []string{"x"}},
+		{name: "escaped blank", line: `echo \  a\ b`, want: []string{" ", "a b"}},
+		{name: "quotes in values stay", vars: map[string]string{"x": `"a b"`}, line: "echo $x", want: []string{`"a`, `b"`}},
+		{name: "unmatched pattern", vars: map[string]string{"x": "*.none"}, line: "echo $x", want: []string{"*.none"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			menu := newBuiltInMenu(false)
+			menu.vars.syncEnv = false
+			menu.vars.unset("IFS")
+			if tt.ifs != nil {
+				menu.vars.set("IFS", *tt.ifs)
+			}
+			for name, value := range tt.vars {
+				menu.vars.set(name, value)
+			}
+			menu.vars.positional = tt.positional
+
+			list, err := parseInput(tt.line, nil)
+			if err != nil {
+				t.Fatalf("parseInput(%q): %v", tt.line, err)
+			}
+			c := list.entries[0].pipeline.commands[0].(*simpleCommand)
+			got, err := expandWords(c.words, menu)
+			if err != nil {
+				t.Fatalf("expandWords(%q): %v", tt.line, err)
+			}
+			if !slices.Equal(got[1:], tt.want) {
+				t.Errorf("expandWords(%q) = %q, want %q", tt.line, got[1:], tt.want)
+			}
+		})
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// glob returns the pathnames matching pattern, sorted, one slash-separated
+// component at a time. Names starting with a dot are only matched by a
+// component starting with a dot, unless dotglob is set. With globstar, a
+// component that is just ** matches any number of directories.
+func glob(pattern string, options map[string]bool) []string {
+	components := strings.Split(pattern, "/")
+	prefixes := []string{""}
+	if components[0] == "" {
+		prefixes = []string{"/"}
+		components = components[1:]
+	}
+
+	for i, component := range components {
+		last := i == len(components)-1
+		next := []string{}
+		for _, prefix := range prefixes {
+			switch {
+			case component == "":
+				// A trailing slash only keeps the directories.
+				if !last || isDirectory(prefix) {
+					next = append(next, prefix)
+				}
+			case !hasPatternChars(component):
+				name := prefix + unescapePattern(component)
+				if !last {
+					next = append(next, name+"/")
+				} else if _, err := os.Lstat(name); err == nil {
+					next = append(next, name)
+				}
+			case component == "**" && options["globstar"]:
+				next = append(next, globStar(prefix, last, options["dotglob"])...)
+			default:
+				next = append(next, globComponent(prefix, component, last, options["dotglob"])...)
+			}
+		}
+		prefixes = next
+	}
+	slices.Sort(prefixes)
+	return prefixes
+}
+
+// globComponent matches component against the entries of the directory
+// prefix names. Unless it is the last component, only directories are kept,
+// ready for the next component.
+func globComponent(prefix string, component string, last bool, dotglob bool) []string {
+	dir := prefix
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	matches := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") && !dotglob && !strings.HasPrefix(component, ".") {
+			continue
+		}
+		if !matchPattern(component, name) {
+			continue
+		}
+		if last {
+			matches = append(matches, prefix+name)
+		} else if isDirectory(prefix + name) {
+			matches = append(matches, prefix+name+"/")
+		}
+	}
+	return matches
+}
+
+// globStar matches ** under prefix: prefix itself and, as the last
+// component, every file and directory below it, otherwise every directory
+// below it. Symbolic links to directories are not followed.
+func globStar(prefix string, last bool, dotglob bool) []string {
+	root := prefix
+	if root == "" {
+		root = "."
+	}
+	matches := []string{}
+	if !last || prefix != "" {
+		matches = append(matches, prefix)
+	}
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".") && !dotglob {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		switch {
+		case last:
+			matches = append(matches, prefix+rel)
+		case entry.IsDir():
+			matches = append(matches, prefix+rel+"/")
+		}
+		return nil
+	})
+	return matches
+}
+
+func isDirectory(path string) bool {
+	if path == "" {
+		return true
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// hasPatternChars reports whether pattern has any unescaped *, ? or [.
+func hasPatternChars(pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+func unescapePattern(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+		}
+		b.WriteByte(pattern[i])
+	}
+	return b.String()
+}
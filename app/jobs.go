@@ -0,0 +1,589 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+type processState int
+
+const (
+	processRunning processState = iota
+	processStopped
+	processDone
+)
+
+// process is one stage of a job. Builtins run inside the shell and have no
+// pid of their own.
+type process struct {
+	pid    int
+	state  processState
+	status int
+	// signal is the signal that terminated the process, if any.
+	signal syscall.Signal
+}
+
+// job is a pipeline the shell keeps track of. With job control its external
+// commands share a process group led by the first of them.
+type job struct {
+	id         int
+	pgid       int
+	command    string
+	processes  []*process
+	background bool
+	// touched orders the jobs for the current (+) and previous (-) marks.
+	touched int
+}
+
+func (j *job) state() processState {
+	state := processDone
+	for _, p := range j.processes {
+		if p.state == processRunning {
+			return processRunning
+		}
+		if p.state == processStopped {
+			state = processStopped
+		}
+	}
+	return state
+}
+
+// status is the status of the last process, which is the status of the job.
+func (j *job) status() int {
+	return j.processes[len(j.processes)-1].status
+}
+
+func (j *job) lastPid() int {
+	for i := len(j.processes) - 1; i >= 0; i-- {
+		if j.processes[i].pid != 0 {
+			return j.processes[i].pid
+		}
+	}
+	return os.Getpid()
+}
+
+// describe returns the state column of a job listing.
+func (j *job) describe() string {
+	switch j.state() {
+	case processRunning:
+		return "Running"
+	case processStopped:
+		return "Stopped"
+	}
+	last := j.processes[len(j.processes)-1]
+	if last.signal != 0 {
+		return capitalize(last.signal.String())
+	}
+	if last.status != 0 {
+		return fmt.Sprintf("Exit %d", last.status)
+	}
+	return "Done"
+}
+
+// terminatingSignal is the signal that killed the last process of a job
+// that is done, or 0.
+func (j *job) terminatingSignal() syscall.Signal {
+	if j.state() != processDone {
+		return 0
+	}
+	return j.processes[len(j.processes)-1].signal
+}
+
+func (j *job) commandLine() string {
+	if j.background && j.state() == processRunning {
+		return j.command + " &"
+	}
+	return j.command
+}
+
+// jobTable holds the jobs of the shell. The processes of a job are watched
+// by goroutines that update them under mu and broadcast on changed.
+type jobTable struct {
+	mu          sync.Mutex
+	changed     *sync.Cond
+	jobs        []*job
+	clock       int
+	interactive bool
+	shellPgid   int
+	// interrupts counts the SIGINTs the shell received itself or that
+	// killed one of its foreground jobs.
+	interrupts int
+}
+
+// newJobTable enables job control only for interactive shells on a
+// terminal. Without it commands stay in the shell's own process group.
+func newJobTable(interactive bool) *jobTable {
+	t := &jobTable{
+		interactive: interactive && term.IsTerminal(int(os.Stdin.Fd())),
+		shellPgid:   syscall.Getpgrp(),
+	}
+	t.changed = sync.NewCond(&t.mu)
+	return t
+}
+
+// catchSignals keeps the signals typed at the terminal from killing or
+// stopping the interactive shell while it is the foreground process group.
+// Being caught rather than ignored, they still reach the commands it runs
+// with their default action. An interrupt breaks out of the wait builtin
+// and of the loops being run.
+func (t *jobTable) catchSignals() {
+	if !t.interactive {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTSTP)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGINT {
+				// End the line the terminal echoed ^C on.
+				fmt.Println()
+				t.interrupt()
+			}
+		}
+	}()
+}
+
+// interrupt records a SIGINT, which stops the waits and the lists of
+// commands in progress.
+func (t *jobTable) interrupt() {
+	t.mu.Lock()
+	t.interrupts++
+	t.changed.Broadcast()
+	t.mu.Unlock()
+}
+
+func (t *jobTable) interruptCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.interrupts
+}
+
+// procAttr returns the process group settings of a command joining pgid, or
+// starting a new group when pgid is 0. The leader of a foreground job takes
+// the terminal before it execs, so it never runs in the background.
+func (t *jobTable) procAttr(pgid int, foreground bool) *syscall.SysProcAttr {
+	if !t.interactive {
+		return nil
+	}
+	attr := &syscall.SysProcAttr{Setpgid: true, Pgid: pgid}
+	if foreground && pgid == 0 {
+		attr.Foreground = true
+		attr.Ctty = int(os.Stdin.Fd())
+	}
+	return attr
+}
+
+// giveTerminalTo makes pgid the foreground process group of the terminal.
+func (t *jobTable) giveTerminalTo(pgid int) {
+	if !t.interactive || pgid == 0 {
+		return
+	}
+	// The shell may be in the background at this point, and a background
+	// process changing the foreground group gets SIGTTOU unless it ignores it.
+	signal.Ignore(syscall.SIGTTOU)
+	unix.IoctlSetPointerInt(int(os.Stdin.Fd()), unix.TIOCSPGRP, pgid)
+	signal.Reset(syscall.SIGTTOU)
+}
+
+func (t *jobTable) reclaimTerminal() {
+	t.giveTerminalTo(t.shellPgid)
+}
+
+func (t *jobTable) add(j *job) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	j.id = 1
+	for _, other := range t.jobs {
+		if other.id >= j.id {
+			j.id = other.id + 1
+		}
+	}
+	t.jobs = append(t.jobs, j)
+	t.touch(j)
+}
+
+// touch makes j the current job. The caller holds mu.
+func (t *jobTable) touch(j *job) {
+	t.clock++
+	j.touched = t.clock
+}
+
+// remove drops j from the table. The caller holds mu.
+func (t *jobTable) remove(j *job) {
+	t.jobs = slices.DeleteFunc(t.jobs, func(other *job) bool { return other == j })
+}
+
+// watch follows a started command until it is done, recording every change
+// of state in p.
+func (t *jobTable) watch(p *process, command pipelineCommand) {
+	command.watch(func(state processState, status int, sig syscall.Signal) {
+		t.mu.Lock()
+		p.state = state
+		p.status = status
+		p.signal = sig
+		t.changed.Broadcast()
+		t.mu.Unlock()
+	})
+}
+
+// waitForeground blocks until j is done or stopped and returns its status.
+// A finished job leaves the table, a stopped one becomes the current job.
+func (t *jobTable) waitForeground(j *job) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	j.background = false
+	for j.state() == processRunning {
+		t.changed.Wait()
+	}
+	if j.state() == processStopped {
+		t.touch(j)
+		return j.status(), true
+	}
+	t.remove(j)
+	return j.status(), false
+}
+
+// statuses returns the status of each process of a job, in pipeline order.
+func (t *jobTable) statuses(j *job) []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	statuses := make([]int, len(j.processes))
+	for i, p := range j.processes {
+		statuses[i] = p.status
+	}
+	return statuses
+}
+
+// reportForeground tells how a foreground job ended when it did not simply
+// exit: it stopped, or a signal other than SIGPIPE killed it. An interrupt
+// only needs the line that ^C was echoed on to be ended.
+func (t *jobTable) reportForeground(out io.Writer, j *job, stopped bool) {
+	switch sig := j.terminatingSignal(); {
+	case stopped:
+		fmt.Fprintf(out, "\n%s\n", t.line(j))
+	case sig == syscall.SIGINT:
+		fmt.Fprintln(out)
+	case sig != 0 && sig != syscall.SIGPIPE:
+		fmt.Fprintln(out, capitalize(sig.String()))
+	}
+}
+
+// wait blocks until none of jobs is running, dropping the ones that are
+// done, and returns the status of the last one. An interrupt stops the wait
+// early with status 130.
+func (t *jobTable) wait(jobs []*job) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	interrupts := t.interrupts
+	status := 0
+	for _, j := range jobs {
+		for j.state() == processRunning {
+			if t.interrupts != interrupts {
+				return 128 + int(syscall.SIGINT)
+			}
+			t.changed.Wait()
+		}
+		if j.state() == processDone {
+			t.remove(j)
+		}
+		status = j.status()
+	}
+	return status
+}
+
+// forget drops jobs from the table without touching their processes.
+func (t *jobTable) forget(jobs []*job) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, j := range jobs {
+		t.remove(j)
+	}
+}
+
+// forgetDone drops the jobs that are done, once they have been reported.
+func (t *jobTable) forgetDone(jobs []*job) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, j := range jobs {
+		if j.state() == processDone {
+			t.remove(j)
+		}
+	}
+}
+
+// resume continues a stopped job, in the foreground or in the background.
+// Its processes count as running straight away, so a wait that follows does
+// not see them stopped before the SIGCONT arrives.
+func (t *jobTable) resume(j *job, foreground bool) {
+	t.mu.Lock()
+	j.background = !foreground
+	for _, p := range j.processes {
+		if p.state == processStopped {
+			p.state = processRunning
+		}
+	}
+	t.touch(j)
+	t.mu.Unlock()
+	if foreground {
+		t.giveTerminalTo(j.pgid)
+	}
+	if j.pgid != 0 {
+		syscall.Kill(-j.pgid, syscall.SIGCONT)
+	}
+}
+
+func (t *jobTable) snapshot() []*job {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.jobs)
+}
+
+// line formats j the way the jobs builtin lists it.
+func (t *jobTable) line(j *job) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return fmt.Sprintf("[%d]%s  %-24s%s", j.id, t.mark(j), j.describe(), j.commandLine())
+}
+
+func (t *jobTable) longLine(j *job) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return fmt.Sprintf("[%d]%s %5d %-24s%s", j.id, t.mark(j), j.lastPid(), j.describe(), j.commandLine())
+}
+
+func (t *jobTable) markOf(j *job) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.mark(j)
+}
+
+// mark returns "+" for the current job, "-" for the previous one and a space
+// for the others. The caller holds mu.
+func (t *jobTable) mark(j *job) string {
+	current, previous := t.currentJobs()
+	switch j {
+	case current:
+		return "+"
+	case previous:
+		return "-"
+	}
+	return " "
+}
+
+// currentJobs returns the two most recently started, stopped or resumed
+// jobs. The caller holds mu.
+func (t *jobTable) currentJobs() (*job, *job) {
+	var current, previous *job
+	for _, j := range t.jobs {
+		switch {
+		case current == nil || j.touched > current.touched:
+			previous = current
+			current = j
+		case previous == nil || j.touched > previous.touched:
+			previous = j
+		}
+	}
+	return current, previous
+}
+
+// finished removes the background jobs that are done and returns their
+// listing lines, for the notices printed before the next prompt.
+func (t *jobTable) finished() []string {
+	lines := []string{}
+	for _, j := range t.snapshot() {
+		t.mu.Lock()
+		done := j.state() == processDone
+		t.mu.Unlock()
+		if !done {
+			continue
+		}
+		lines = append(lines, t.line(j))
+		t.mu.Lock()
+		t.remove(j)
+		t.mu.Unlock()
+	}
+	return lines
+}
+
+// find resolves a job spec: %n or n, %+ or %% for the current job, %- for
+// the previous one, %string for the job whose command starts with string
+// and %?string for the one containing it.
+func (t *jobTable) find(spec string) (*job, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	current, previous := t.currentJobs()
+	name := strings.TrimPrefix(spec, "%")
+	switch name {
+	case "", "%", "+":
+		if current == nil {
+			return nil, fmt.Errorf("current: no such job")
+		}
+		return current, nil
+	case "-":
+		if previous == nil {
+			return nil, fmt.Errorf("previous: no such job")
+		}
+		return previous, nil
+	}
+
+	if n, err := strconv.Atoi(name); err == nil {
+		for _, j := range t.jobs {
+			if j.id == n {
+				return j, nil
+			}
+		}
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+
+	var found *job
+	for _, j := range t.jobs {
+		matches := strings.HasPrefix(j.command, name)
+		if pattern, ok := strings.CutPrefix(name, "?"); ok {
+			matches = strings.Contains(j.command, pattern)
+		}
+		if !matches {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("%s: ambiguous job spec", spec)
+		}
+		found = j
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+	return found, nil
+}
+
+// byPid returns the job that pid belongs to.
+func (t *jobTable) byPid(pid int) *job {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, j := range t.jobs {
+		for _, p := range j.processes {
+			if p.pid == pid {
+				return j
+			}
+		}
+	}
+	return nil
+}
+
+func (t *jobTable) isStopped(j *job) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return j.state() == processStopped
+}
+
+// signal sends sig to the process group of j or, in a shell without job
+// control where jobs have no group of their own, to each of its running
+// processes. A stopped job is continued too, as it could not act on most
+// signals otherwise. On failure it returns the pid it could not signal.
+func (t *jobTable) signal(j *job, sig syscall.Signal) (int, error) {
+	targets := []int{-j.pgid}
+	if j.pgid == 0 {
+		targets = t.runningPids(j)
+		if len(targets) == 0 {
+			return j.lastPid(), syscall.ESRCH
+		}
+	}
+	for _, target := range targets {
+		if err := syscall.Kill(target, sig); err != nil {
+			if target < 0 {
+				return j.pgid, err
+			}
+			return target, err
+		}
+	}
+	switch sig {
+	case syscall.SIGSTOP, syscall.SIGTSTP, syscall.SIGTTIN, syscall.SIGTTOU, syscall.SIGCONT:
+		return 0, nil
+	}
+	if t.isStopped(j) {
+		for _, target := range targets {
+			syscall.Kill(target, syscall.SIGCONT)
+		}
+	}
+	return 0, nil
+}
+
+// runningPids returns the processes of j that have not finished yet.
+func (t *jobTable) runningPids(j *job) []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pids := []int{}
+	for _, p := range j.processes {
+		if p.pid != 0 && p.state != processDone {
+			pids = append(pids, p.pid)
+		}
+	}
+	return pids
+}
+
+var signalNames = map[string]syscall.Signal{
+	"HUP":    syscall.SIGHUP,
+	"INT":    syscall.SIGINT,
+	"QUIT":   syscall.SIGQUIT,
+	"ILL":    syscall.SIGILL,
+	"TRAP":   syscall.SIGTRAP,
+	"ABRT":   syscall.SIGABRT,
+	"BUS":    syscall.SIGBUS,
+	"FPE":    syscall.SIGFPE,
+	"KILL":   syscall.SIGKILL,
+	"USR1":   syscall.SIGUSR1,
+	"SEGV":   syscall.SIGSEGV,
+	"USR2":   syscall.SIGUSR2,
+	"PIPE":   syscall.SIGPIPE,
+	"ALRM":   syscall.SIGALRM,
+	"TERM":   syscall.SIGTERM,
+	"CHLD":   syscall.SIGCHLD,
+	"CONT":   syscall.SIGCONT,
+	"STOP":   syscall.SIGSTOP,
+	"TSTP":   syscall.SIGTSTP,
+	"TTIN":   syscall.SIGTTIN,
+	"TTOU":   syscall.SIGTTOU,
+	"URG":    syscall.SIGURG,
+	"XCPU":   syscall.SIGXCPU,
+	"XFSZ":   syscall.SIGXFSZ,
+	"VTALRM": syscall.SIGVTALRM,
+	"PROF":   syscall.SIGPROF,
+	"WINCH":  syscall.SIGWINCH,
+	"IO":     syscall.SIGIO,
+	"SYS":    syscall.SIGSYS,
+}
+
+// parseSignal accepts a signal number or a name with or without its SIG
+// prefix, in any case.
+func parseSignal(spec string) (syscall.Signal, bool) {
+	if n, err := strconv.Atoi(spec); err == nil {
+		return syscall.Signal(n), n >= 0 && n < 65
+	}
+	sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(spec), "SIG")]
+	return sig, ok
+}
+
+func signalName(sig syscall.Signal) string {
+	for name, s := range signalNames {
+		if s == sig {
+			return name
+		}
+	}
+	return strconv.Itoa(int(sig))
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
@@ -1,36 +1,180 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"os/exec"
+	"os/user"
+	"path/filepath"
 	"slices"
 	"strings"
-	"sync"
+	"syscall"
 
 	"golang.org/x/term"
 )
 
-type commandReceived struct {
-	command string
-	params  []string
-}
-
 const terminalChar = "$ "
 
+// The startup files, looked up in the home directory. $GOSHRC overrides the
+// rc file.
+const (
+	rcFile      = ".gosrc"
+	profileFile = ".gos_profile"
+)
+
+const syntaxErrorStatus = 2
+
 func main() {
-	commandMenu := newBuiltInMenu()
-	fmt.Fprint(os.Stdout, terminalChar)
+	args := os.Args[1:]
+	// Like other shells, a login shell is asked for with -l or by a leading
+	// dash in the name it was started under.
+	login := strings.HasPrefix(os.Args[0], "-")
+	for len(args) > 0 && (args[0] == "-l" || args[0] == "--login") {
+		login = true
+		args = args[1:]
+	}
+	state, inherited := os.LookupEnv(subshellStateVariable)
+	os.Unsetenv(subshellStateVariable)
+
+	switch {
+	case len(args) > 0 && args[0] == "-c":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "%s: -c: option requires an argument\n", os.Args[0])
+			os.Exit(syntaxErrorStatus)
+		}
+		menu := startShell(false, login)
+		if len(args) > 2 {
+			menu.vars.shellName = args[2]
+			menu.vars.positional = args[3:]
+		}
+		name, firstLine := menu.vars.shellName, 1
+		if inherited {
+			// A subshell goes on counting the lines of its parent, and
+			// stays as quiet about them as a parent reading typed lines.
+			if firstLine = menu.restoreState(state); firstLine == 0 {
+				name, firstLine = "", 1
+			}
+		}
+		os.Exit(runScript(strings.NewReader(args[1]), name, firstLine, menu, standardFds()))
+	case len(args) > 0:
+		f, err := os.Open(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], describeOpenError(err))
+			os.Exit(commandNotFoundStatus)
+		}
+		menu := startShell(false, login)
+		menu.vars.shellName = args[0]
+		menu.vars.positional = args[1:]
+		os.Exit(runScript(f, args[0], 1, menu, standardFds()))
+	case !term.IsTerminal(int(os.Stdin.Fd())):
+		menu := startShell(false, login)
+		os.Exit(runScript(os.Stdin, menu.vars.shellName, 1, menu, standardFds()))
+	}
+	runInteractive(startShell(true, login))
+}
+
+// startShell creates the shell state and runs the startup files: the
+// profile for login shells, then the rc file for interactive ones.
+func startShell(interactive bool, login bool) *builtInMenu {
+	menu := newBuiltInMenu(interactive)
+	home, _ := os.UserHomeDir()
+	if login {
+		sourceStartupFile(filepath.Join(home, profileFile), menu)
+	}
+	if interactive {
+		rc := filepath.Join(home, rcFile)
+		if custom, ok := menu.vars.get("GOSHRC"); ok && custom != "" {
+			rc = custom
+		}
+		sourceStartupFile(rc, menu)
+	}
+	return menu
+}
+
+// sourceStartupFile runs a startup file in the shell's context, if it exists.
+func sourceStartupFile(path string, menu *builtInMenu) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, describeOpenError(err))
+		return
+	}
+	defer f.Close()
+	runScript(f, path, 1, menu, standardFds())
+}
+
+// runScript executes the commands read from r without the line editor and
+// returns the status of the last one. Lines are gathered until they make up
+// complete commands, so a here-document can span several of them. A syntax
+// error ends the script with status 2. Diagnostics name the script and
+// count its lines from firstLine.
+func runScript(r io.Reader, name string, firstLine int, menu *builtInMenu, fds fdTable) int {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	saved := menu.location
+	defer func() { menu.location = saved }()
+	menu.location = location{name: name}
+	pendingLines := []string{}
+	lineNumber, startLine := firstLine-1, firstLine
+	for {
+		more := scanner.Scan()
+		if more {
+			lineNumber++
+			if len(pendingLines) == 0 {
+				startLine = lineNumber
+			}
+			pendingLines = append(pendingLines, scanner.Text())
+		}
+		text := strings.Join(pendingLines, "\n")
+		if more && needsMoreInput(text) {
+			continue
+		}
+		if len(pendingLines) > 0 {
+			menu.location.base = startLine - 1
+			list, err := parseInput(text, menu.aliasTable())
+			var syntaxErr *syntaxError
+			// Like bash, let the end of the script end a here-document
+			// that is still waiting for its delimiter, with a warning.
+			for !more && errors.As(err, &syntaxErr) && syntaxErr.delimiter != "" {
+				menu.location.line = lineNumber
+				menu.errorf(fds[2], "warning: here-document at line %d delimited by end-of-file (wanted `%s')",
+					startLine+syntaxErr.line-1, syntaxErr.delimiter)
+				text += "\n" + syntaxErr.delimiter
+				list, err = parseInput(text, menu.aliasTable())
+			}
+			if errors.As(err, &syntaxErr) {
+				menu.location.line = startLine + syntaxErr.line - 1
+				menu.errorf(fds[2], "%s", err)
+				menu.vars.lastStatus = syntaxErrorStatus
+				return syntaxErrorStatus
+			}
+			executeList(list, menu, fds)
+			pendingLines = []string{}
+			menu.aborting = false
+		}
+		if !more || menu.returning {
+			return menu.vars.lastStatus
+		}
+	}
+}
+
+// runInteractive reads commands with the line editor until the user exits.
+func runInteractive(commandMenu *builtInMenu) {
+	fmt.Fprint(os.Stdout, primaryPrompt(commandMenu))
 
 	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
 	if err != nil {
 		panic(err)
 	}
 	defer term.Restore(int(os.Stdin.Fd()), oldState)
-	err = manageHistory("-r", oldState, &commandMenu.history)
+	commandMenu.termState = oldState
+	commandMenu.jobs.catchSignals()
+	err = manageHistory("-r", &commandMenu.history)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -38,6 +182,10 @@ func main() {
 	var buffer strings.Builder
 	input := make([]byte, 3)
 	tabCounter := 0
+	prompt := primaryPrompt(commandMenu)
+	// pendingLines holds the lines of a command that is still waiting for
+	// continuation lines, such as the body of a here-document.
+	pendingLines := []string{}
 	for {
 		n, err := os.Stdin.Read(input)
 		if err != nil || n == 0 {
@@ -49,135 +197,50 @@ func main() {
 
 			switch key {
 			case 3: // Ctrl+C
-				fmt.Print("\r\nExiting.\r\n")
-				return
-
-			case '\r', '\n': // ENTER
-				commandTyped := buffer.String()
-				if len(commandTyped) == 0 {
-					fmt.Print("\r\n")
-					fmt.Print(terminalChar)
-					continue
-				}
-				commandMenu.history = append(commandMenu.history, commandTyped)
+				buffer.Reset()
+				pendingLines = []string{}
+				prompt = primaryPrompt(commandMenu)
+				tabCounter = 0
 				commandMenu.cmdIndex = len(commandMenu.history)
-				commands, hasPipeline := parseInput(commandTyped)
-				if len(commands) == 0 {
-					fmt.Printf("\r\n%s: command not found\r\n", commandTyped)
-					buffer.Reset()
-					fmt.Print(terminalChar)
-					continue
-				}
+				commandMenu.vars.lastStatus = 128 + int(syscall.SIGINT)
+				fmt.Print("^C\r\n")
+				fmt.Print(prompt)
 
-				if hasPipeline {
-					fmt.Print("\r\n")
-					term.Restore(int(os.Stdin.Fd()), oldState)
-					err := processPipeline(commands, commandMenu, oldState)
-					if err != nil {
-						log.Fatal(err)
-					}
-					oldState, err = term.MakeRaw(int(os.Stdin.Fd()))
-					if err != nil {
-						panic(err)
-					}
-					buffer.Reset()
-					fmt.Printf("\r%s", terminalChar)
-					continue
-				}
-
-				commandData := commands[0]
-				builtInCommand, ok := commandMenu.commands[commandData.command]
-				if !ok {
-					path := getCommandDirectoryAsync(commandData.command)
-					if path != "" {
-						paramsWithoutSpaces := filterSpacesFromParams(commandData.params)
-						commandParams, destinationSlice, actionT, redirectionT, err := hasOutputRedirection(paramsWithoutSpaces)
-						if err != nil {
-							log.Fatal(err)
-						}
-
-						cmd := exec.Command(commandData.command, commandParams...)
-
-						var stdoutBuf, stderrBuf bytes.Buffer
-
-						stdoutPipe, err := cmd.StdoutPipe()
-						if err != nil {
-							log.Fatal(err)
-						}
-
-						stderrPipe, err := cmd.StderrPipe()
-						if err != nil {
-							log.Fatal(err)
-						}
-
-						if err := cmd.Start(); err != nil {
-							log.Fatal(err)
-						}
-
-						stdoutWriter := io.Writer(&stdoutBuf)
-						stderrWriter := io.Writer(&stderrBuf)
-
-						var wg sync.WaitGroup
-						wg.Add(2)
-
-						go func() {
-							defer wg.Done()
-							io.Copy(stdoutWriter, stdoutPipe)
-						}()
-
-						go func() {
-							defer wg.Done()
-							io.Copy(stderrWriter, stderrPipe)
-						}()
-
-						cmd.Wait()
-						wg.Wait()
-
-						stdoutBytes := stdoutBuf.Bytes()
-						stderrBytes := stderrBuf.Bytes()
-
-						stdout := stdoutBuf.String()
-						stderr := stderrBuf.String()
-
-						processExternalCommandOutput(stdout, stdoutBytes, stderr, stderrBytes, destinationSlice, actionT, redirectionT)
-						buffer.Reset()
-						fmt.Printf("\r\n%s", terminalChar)
-						continue
-					}
-					fmt.Printf("\r\n%s: command not found\r\n", commandTyped)
-					buffer.Reset()
-					fmt.Print(terminalChar)
+			case 4: // Ctrl+D
+				if buffer.Len() > 0 || len(pendingLines) > 0 {
 					continue
 				}
+				runTyped("exit", commandMenu)
+				fmt.Print(prompt)
 
+			case '\r', '\n': // ENTER
+				commandTyped := buffer.String()
 				buffer.Reset()
-				var output bytes.Buffer
-				commandParams, destinationSlice, actionT, redirectionT, err := hasOutputRedirection(commandData.params)
-				if err != nil {
-					term.Restore(int(os.Stdin.Fd()), oldState)
-					log.Fatal(err)
-				}
-				err = builtInCommand(os.Stdin, &output, commandParams, oldState, &commandMenu.history)
-				if err != nil {
-					term.Restore(int(os.Stdin.Fd()), oldState)
-					log.Fatal(err)
-				}
-				shouldPrint, err := checkRedirection(output, destinationSlice, actionT, redirectionT, oldState)
-				if err != nil {
-					term.Restore(int(os.Stdin.Fd()), oldState)
-					log.Fatal(err)
+				fmt.Print("\r\n")
+				if len(commandTyped) == 0 && len(pendingLines) == 0 {
+					printJobNotices(commandMenu)
+					fmt.Print(prompt)
+					continue
 				}
-				if shouldPrint && output.Len() > 0 {
-					fmt.Printf("\r\n%s", output.String())
-					fmt.Printf("\r%s", terminalChar)
-				} else {
-					fmt.Printf("\r\n%s", terminalChar)
+				pendingLines = append(pendingLines, commandTyped)
+				commandTyped = strings.Join(pendingLines, "\n")
+				if needsMoreInput(commandTyped) {
+					prompt = continuationPrompt(commandMenu)
+					fmt.Print(prompt)
+					continue
 				}
+				pendingLines = []string{}
+				commandMenu.history = append(commandMenu.history, commandTyped)
+				commandMenu.cmdIndex = len(commandMenu.history)
+				runTyped(commandTyped, commandMenu)
+				printJobNotices(commandMenu)
+				prompt = primaryPrompt(commandMenu)
+				fmt.Print(prompt)
 
 			case '\t': // TAB
 				current := buffer.String()
 				if len(current) >= 3 {
-					matches := commandMenu.prefixTrie.prefixSearch(current)
+					matches := commandMenu.completionTrie().prefixSearch(current)
 					if len(matches) == 0 {
 						fmt.Print("\x07")
 						continue
@@ -187,7 +250,7 @@ func main() {
 						buffer.Reset()
 						buffer.WriteString(currentMatch + " ")
 						fmt.Print("\033[2K\r")
-						fmt.Printf("$ %s ", currentMatch)
+						fmt.Printf("%s%s ", prompt, currentMatch)
 					}
 					if len(matches) > 1 {
 						commonPrefix := findLongestCommonPrefix(matches)
@@ -195,7 +258,7 @@ func main() {
 							buffer.Reset()
 							buffer.WriteString(commonPrefix)
 							fmt.Print("\033[2K\r")
-							fmt.Printf("$ %s", commonPrefix)
+							fmt.Printf("%s%s", prompt, commonPrefix)
 							continue
 						}
 						if tabCounter == 0 {
@@ -207,7 +270,7 @@ func main() {
 							currentMatch := strings.Join(matches, "  ")
 							fmt.Print("\r\n")
 							fmt.Print(currentMatch + "\r\n")
-							fmt.Printf("$ %s", buffer.String())
+							fmt.Printf("%s%s", prompt, buffer.String())
 							tabCounter = 0
 						}
 					}
@@ -219,7 +282,7 @@ func main() {
 					s = s[:len(s)-1]
 					buffer.Reset()
 					buffer.WriteString(s)
-					fmt.Printf("\r$ %s \b", s) // redraw current buffer
+					fmt.Printf("\r%s%s \b", prompt, s) // redraw current buffer
 				}
 
 			case 27:
@@ -227,7 +290,7 @@ func main() {
 					if len(commandMenu.history) == 0 {
 						buffer.Reset()
 						fmt.Print("\033[2K\r")
-						fmt.Print(terminalChar)
+						fmt.Print(prompt)
 						i += 2
 						continue
 					}
@@ -240,7 +303,7 @@ func main() {
 						buffer.Reset()
 						buffer.WriteString(cmd)
 						fmt.Print("\033[2K\r")
-						fmt.Printf("$ %s", cmd)
+						fmt.Printf("%s%s", prompt, cmd)
 
 					case 'B': // DOWN ARROW
 						if commandMenu.cmdIndex < len(commandMenu.history)-1 {
@@ -250,7 +313,7 @@ func main() {
 						buffer.Reset()
 						buffer.WriteString(cmd)
 						fmt.Print("\033[2K\r")
-						fmt.Printf("$ %s", cmd)
+						fmt.Printf("%s%s", prompt, cmd)
 					}
 					i += 2
 				}
@@ -265,3 +328,192 @@ func main() {
 	}
 
 }
+
+// primaryPrompt is shown before a new command: PS1 when it is set, like in
+// bash, and terminalChar otherwise.
+func primaryPrompt(menu *builtInMenu) string {
+	if ps1, ok := menu.vars.get("PS1"); ok {
+		return expandPrompt(ps1)
+	}
+	return terminalChar
+}
+
+// continuationPrompt is shown while a command spans several lines, like
+// bash's PS2.
+func continuationPrompt(menu *builtInMenu) string {
+	if ps2, ok := menu.vars.get("PS2"); ok {
+		return expandPrompt(ps2)
+	}
+	return "> "
+}
+
+// expandPrompt replaces the prompt escapes bash users rely on most: \u for
+// the user, \h for the host, \w and \W for the working directory, \$ for #
+// or $ depending on root, and \\ for a backslash.
+func expandPrompt(prompt string) string {
+	var b strings.Builder
+	for i := 0; i < len(prompt); i++ {
+		if prompt[i] != '\\' || i+1 == len(prompt) {
+			b.WriteByte(prompt[i])
+			continue
+		}
+		i++
+		switch prompt[i] {
+		case 'u':
+			if u, err := user.Current(); err == nil {
+				b.WriteString(u.Username)
+			}
+		case 'h':
+			host, _ := os.Hostname()
+			b.WriteString(strings.SplitN(host, ".", 2)[0])
+		case 'w', 'W':
+			dir, _ := os.Getwd()
+			if home, err := os.UserHomeDir(); err == nil && (dir == home || strings.HasPrefix(dir, home+"/")) {
+				dir = "~" + dir[len(home):]
+			}
+			if prompt[i] == 'W' && dir != "/" && dir != "~" {
+				dir = filepath.Base(dir)
+			}
+			b.WriteString(dir)
+		case '$':
+			if os.Geteuid() == 0 {
+				b.WriteByte('#')
+			} else {
+				b.WriteByte('$')
+			}
+		case '\\':
+			b.WriteByte('\\')
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(prompt[i])
+		}
+	}
+	return b.String()
+}
+
+// runTyped runs a line typed at the prompt. The terminal leaves raw mode
+// for as long as the line runs, so the commands and the shell's own messages
+// see an ordinary cooked terminal.
+func runTyped(line string, menu *builtInMenu) {
+	term.Restore(int(os.Stdin.Fd()), menu.termState)
+	runCommandLine(line, menu)
+	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		panic(err)
+	}
+	menu.termState = oldState
+}
+
+func runCommandLine(line string, menu *builtInMenu) {
+	list, err := parseInput(line, menu.aliasTable())
+	if err != nil {
+		var syntaxErr *syntaxError
+		if errors.As(err, &syntaxErr) && !strings.Contains(line, "\n") {
+			fmt.Fprintf(os.Stderr, "%s^\n", strings.Repeat(" ", len(primaryPrompt(menu))+syntaxErr.column-1))
+		}
+		fmt.Fprintln(os.Stderr, err)
+		menu.vars.lastStatus = syntaxErrorStatus
+		return
+	}
+	executeList(list, menu, standardFds())
+	menu.aborting = false
+}
+
+// executeList runs every pipeline of a list in order, skipping the ones whose
+// && or || condition is not met by the previous status. return, break,
+// continue and an interrupt stop it early. fds are the
+// descriptors the list runs with, the shell's own unless it was redirected
+// as a whole, as in "source file > log".
+func executeList(list *commandList, menu *builtInMenu, fds fdTable) int {
+	interrupts := menu.jobs.interruptCount()
+	for _, entry := range list.entries {
+		if entry.operator == AND && menu.vars.lastStatus != 0 {
+			continue
+		}
+		if entry.operator == OR && menu.vars.lastStatus == 0 {
+			continue
+		}
+		menu.location.line = menu.location.base + entry.pipeline.line
+		if entry.background {
+			menu.vars.lastStatus = runBackground(entry.pipeline, menu, fds)
+			continue
+		}
+		menu.vars.lastStatus = runPipeline(entry.pipeline, menu, fds)
+		if menu.unwinding() || menu.jobs.interruptCount() != interrupts {
+			break
+		}
+	}
+	return menu.vars.lastStatus
+}
+
+// runPipeline runs a pipeline in the foreground, with the terminal handed
+// over to it, and waits until it is done or stopped.
+func runPipeline(p *pipeline, menu *builtInMenu, fds fdTable) int {
+	if c, ok := p.commands[0].(*simpleCommand); ok && len(p.commands) == 1 && len(c.words) == 0 {
+		status := runAssignments(c, menu, fds)
+		menu.vars.setPipeStatus([]int{status})
+		return status
+	}
+
+	j, err := processPipeline(p, menu, fds, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	status, stopped := menu.jobs.waitForeground(j)
+	menu.vars.setPipeStatus(menu.jobs.statuses(j))
+	menu.jobs.reclaimTerminal()
+	menu.jobs.reportForeground(fds[1], j, stopped)
+	// Like bash, treat a job killed by ^C as if the shell was interrupted
+	// too, so the rest of a function or list does not run.
+	if !stopped && j.terminatingSignal() == syscall.SIGINT {
+		menu.jobs.interrupt()
+	}
+	return status
+}
+
+// runBackground starts a pipeline terminated by & as a job and returns
+// without waiting for it.
+func runBackground(p *pipeline, menu *builtInMenu, fds fdTable) int {
+	j, err := processPipeline(p, menu, fds, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	menu.vars.lastBgPid = j.lastPid()
+	if menu.interactive {
+		fmt.Fprintf(os.Stderr, "[%d] %d\n", j.id, j.lastPid())
+	}
+	return 0
+}
+
+// printJobNotices reports the background jobs that finished since the last
+// prompt.
+func printJobNotices(menu *builtInMenu) {
+	for _, line := range menu.jobs.finished() {
+		fmt.Printf("%s\r\n", line)
+	}
+}
+
+// runAssignments handles a command without words: its redirections are
+// still performed, so "> file" truncates file, and its assignments change
+// the shell's own variables. The status is that of the last command
+// substitution in their values, if any.
+func runAssignments(c *simpleCommand, menu *builtInMenu, fds fdTable) int {
+	_, opened, err := applyRedirections(c.redirections, fds, menu)
+	if err != nil {
+		reportExpansionError(fds[2], err, menu)
+		return 1
+	}
+	closeAll(opened)
+
+	status := 0
+	for _, a := range c.assignments {
+		if err := assignVariable(a, menu); err != nil {
+			reportExpansionError(fds[2], err, menu)
+			return 1
+		}
+		if a.hasSubstitution() {
+			status = menu.vars.lastStatus
+		}
+	}
+	return status
+}
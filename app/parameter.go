@@ -0,0 +1,540 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// parameterOperators are the operators that may follow the name in a ${...}
+// expansion, longest first so that "##" wins over "#".
+var parameterOperators = []string{
+	":-", ":=", ":?", ":+", "-", "=", "?", "+",
+	"##", "#", "%%", "%", "//", "/#", "/%", "/",
+	"^^", "^", ",,", ",", ":",
+}
+
+// parameterExpansion is the text of a parameter reference split into the
+// parameter and the operator applied to it, if any. subscript is the text
+// between the brackets of an array reference like name[subscript]. length
+// is set for ${#name} and keys for ${!name[@]}, which lists the keys of an
+// array.
+type parameterExpansion struct {
+	text         string
+	name         string
+	subscript    string
+	hasSubscript bool
+	length       bool
+	keys         bool
+	op           string
+	operand      string
+}
+
+func parseParameterExpansion(text string) (parameterExpansion, error) {
+	e := parameterExpansion{text: text}
+	if len(text) > 1 && (text[0] == '#' || text[0] == '!') {
+		if n := e.parseReference(text[1:]); n == len(text)-1 {
+			e.length = text[0] == '#'
+			e.keys = text[0] == '!'
+			if e.keys && !e.isArrayList() {
+				return e, e.badSubstitution()
+			}
+			return e, nil
+		}
+	}
+	n := e.parseReference(text)
+	rest := text[n:]
+	if n == 0 {
+		return e, e.badSubstitution()
+	}
+	if rest == "" {
+		return e, nil
+	}
+	for _, op := range parameterOperators {
+		if strings.HasPrefix(rest, op) {
+			e.op = op
+			e.operand = rest[len(op):]
+			return e, nil
+		}
+	}
+	return e, e.badSubstitution()
+}
+
+func (e parameterExpansion) badSubstitution() error {
+	return fmt.Errorf("${%s}: bad substitution", e.text)
+}
+
+// parseReference reads the parameter, and the subscript that may follow
+// the name of a variable, that text starts with. It returns the length of
+// the reference.
+func (e *parameterExpansion) parseReference(text string) int {
+	e.name = parameterName(text)
+	n := len(e.name)
+	if !isValidName(e.name) || n == len(text) || text[n] != '[' {
+		return n
+	}
+	depth := 0
+	for i := n; i < len(text); i++ {
+		switch text[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				e.subscript = text[n+1 : i]
+				e.hasSubscript = true
+				return i + 1
+			}
+		}
+	}
+	return n
+}
+
+// parameterName is the parameter text starts with: a variable name, the
+// number of a positional parameter or a special parameter.
+func parameterName(text string) string {
+	if text == "" {
+		return ""
+	}
+	end := 1
+	switch {
+	case isNameStart(text[0]):
+		for end < len(text) && isNameChar(text[end]) {
+			end++
+		}
+	case isDigit(text[0]):
+		for end < len(text) && isDigit(text[end]) {
+			end++
+		}
+	case !isSpecialParam(text[0]):
+		return ""
+	}
+	return text[:end]
+}
+
+// isList reports whether the parameter stands for a list of values: the
+// positional parameters or all the elements of an array.
+func (e parameterExpansion) isList() bool {
+	return e.isPositional() || e.isArrayList()
+}
+
+func (e parameterExpansion) isPositional() bool {
+	return e.name == "@" || e.name == "*"
+}
+
+func (e parameterExpansion) isArrayList() bool {
+	return e.hasSubscript && (e.subscript == "@" || e.subscript == "*")
+}
+
+// joins reports whether the values of a list are joined into a single
+// field, as they are by "$*" and "${arr[*]}".
+func (e parameterExpansion) joins(quoted bool) bool {
+	return quoted && (e.name == "*" || e.hasSubscript && e.subscript == "*")
+}
+
+// expandParameter expands a parameter reference, plain like $x or with an
+// operator like ${x:-default}, into fields. Most give a single field, but @
+// and an unquoted * give one per positional parameter, and so may an
+// operand like "$@". An unquoted expansion gives fields that are still to
+// be split.
+func expandParameter(t Token, menu *builtInMenu) ([]field, error) {
+	e, err := parseParameterExpansion(t.literal)
+	if err != nil {
+		return nil, err
+	}
+	values, set, err := parameterValues(e, menu)
+	if err != nil {
+		return nil, err
+	}
+	null := strings.Join(values, "") == ""
+	missing := !set || (strings.HasPrefix(e.op, ":") && null)
+
+	switch e.op {
+	case "":
+		if e.length {
+			return []field{expansionField(strconv.Itoa(parameterLength(e, values)), t.quoted)}, nil
+		}
+	case ":-", "-":
+		if missing {
+			return operandFields(e, t, menu)
+		}
+	case ":+", "+":
+		if !missing {
+			return operandFields(e, t, menu)
+		}
+		values = []string{""}
+	case ":=", "=":
+		if missing {
+			value, err := expandWord(tokenizeOperand(e.operand, t.quoted), menu)
+			if err != nil {
+				return nil, err
+			}
+			if err := assignParameter(e, value, menu); err != nil {
+				return nil, err
+			}
+			values = []string{value}
+		}
+	case ":?", "?":
+		if missing {
+			return nil, parameterMissing(e, t, menu)
+		}
+	case ":":
+		if values, err = substring(e, values, menu); err != nil {
+			return nil, err
+		}
+	default:
+		if values, err = transformValues(e, t, values, menu); err != nil {
+			return nil, err
+		}
+	}
+	return valueFields(e, values, t.quoted, menu.vars), nil
+}
+
+// parameterValues looks up a parameter: the positional parameters for @ and
+// *, the elements or keys of an array for name[@] and name[*], and
+// otherwise a single value.
+func parameterValues(e parameterExpansion, menu *builtInMenu) ([]string, bool, error) {
+	switch {
+	case e.isPositional():
+		return menu.vars.positional, len(menu.vars.positional) > 0, nil
+	case e.isArrayList():
+		keys, values := menu.vars.elements(e.name)
+		if e.keys {
+			values = keys
+		}
+		return values, len(values) > 0, nil
+	case e.hasSubscript:
+		subscript, err := expandWord(tokenizeOperand(e.subscript, false), menu)
+		if err != nil {
+			return nil, false, err
+		}
+		value, ok := menu.vars.element(e.name, subscript)
+		return []string{value}, ok, nil
+	}
+	value, ok := menu.vars.get(e.name)
+	return []string{value}, ok, nil
+}
+
+// assignParameter implements the assignment of ${name:=word}, which only
+// variables and array elements allow.
+func assignParameter(e parameterExpansion, value string, menu *builtInMenu) error {
+	if !isValidName(e.name) || e.isArrayList() {
+		return fmt.Errorf("$%s: cannot assign in this way", strings.TrimSuffix(e.text, e.op+e.operand))
+	}
+	if !e.hasSubscript {
+		return menu.vars.set(e.name, value)
+	}
+	subscript, err := expandWord(tokenizeOperand(e.subscript, false), menu)
+	if err != nil {
+		return err
+	}
+	return menu.vars.setElement(e.name, subscript, value)
+}
+
+// parameterLength is the value of ${#name}: the number of characters of
+// the value, or the number of values of a list.
+func parameterLength(e parameterExpansion, values []string) int {
+	if e.isList() {
+		return len(values)
+	}
+	return len([]rune(values[0]))
+}
+
+// valueFields turns the values of an expansion into fields. "$*" joins the
+// positional parameters into one field, while $@, "$@" and an unquoted $*
+// keep them apart, and so do the same forms of ${arr[@]} and ${arr[*]}.
+// "$*" separates the values by the first character of IFS.
+func valueFields(e parameterExpansion, values []string, quoted bool, vars *variableStore) []field {
+	if !e.isList() {
+		return []field{expansionField(strings.Join(values, ""), quoted)}
+	}
+	if e.joins(quoted) {
+		separator := vars.fieldSeparators()
+		if separator != "" {
+			separator = separator[:1]
+		}
+		return []field{expansionField(strings.Join(values, separator), quoted)}
+	}
+	fields := []field{}
+	for _, v := range values {
+		fields = append(fields, expansionField(v, quoted))
+	}
+	return fields
+}
+
+func expansionField(text string, quoted bool) field {
+	f := field{}
+	f.addExpansion(text, quoted)
+	return f
+}
+
+// operandFields expands the operand of ${x:-word} or ${x:+word} into the
+// fields the expansion stands for. Outside double quotes, the text of the
+// operand that was not quoted is subject to field splitting, like the
+// result of any other unquoted expansion.
+func operandFields(e parameterExpansion, t Token, menu *builtInMenu) ([]field, error) {
+	fields, err := expandWordFields(tokenizeOperand(e.operand, t.quoted), menu)
+	if err != nil {
+		return nil, err
+	}
+	if t.quoted {
+		// Like any quoted expansion, it is a field even when it is empty.
+		fields[len(fields)-1].add("", true)
+	} else {
+		for _, f := range fields {
+			for i := range f.segments {
+				f.segments[i].split = f.segments[i].split || !f.segments[i].quoted
+			}
+		}
+	}
+	return fields, nil
+}
+
+// unsetParameterError is the failure of ${var?message} when var is unset.
+type unsetParameterError struct {
+	name    string
+	message string
+}
+
+func (e *unsetParameterError) Error() string {
+	return e.name + ": " + e.message
+}
+
+func parameterMissing(e parameterExpansion, t Token, menu *builtInMenu) error {
+	message, err := expandWord(tokenizeOperand(e.operand, t.quoted), menu)
+	if err != nil {
+		return err
+	}
+	if message == "" {
+		message = "parameter null or not set"
+		if e.op == "?" {
+			message = "parameter not set"
+		}
+	}
+	return &unsetParameterError{name: e.name, message: message}
+}
+
+// substring implements ${x:offset:length}, where both are arithmetic
+// expressions. A negative offset counts from the end, and so does a
+// negative length, which marks where the substring ends. For a list it
+// selects values instead, where the positional parameters count $0 as the
+// first.
+func substring(e parameterExpansion, values []string, menu *builtInMenu) ([]string, error) {
+	offsetText, lengthText, hasLength := strings.Cut(e.operand, ":")
+	offset, err := arithmeticOperand(offsetText, menu)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []string
+	switch {
+	case e.isPositional():
+		items = append([]string{menu.vars.shellName}, values...)
+	case e.isList():
+		items = values
+	default:
+		for _, r := range values[0] {
+			items = append(items, string(r))
+		}
+	}
+
+	start := int(offset)
+	if start < 0 {
+		start += len(items)
+	}
+	if start < 0 || start > len(items) {
+		return emptyValues(e), nil
+	}
+	end := len(items)
+	if hasLength {
+		length, err := arithmeticOperand(lengthText, menu)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case length < 0 && e.isList():
+			return nil, fmt.Errorf("%s: substring expression < 0", strings.TrimSpace(lengthText))
+		case length < 0:
+			end = len(items) + int(length)
+		case int64(start)+length < int64(end):
+			end = start + int(length)
+		}
+		if end < start {
+			return nil, fmt.Errorf("%s: substring expression < 0", strings.TrimSpace(lengthText))
+		}
+	}
+
+	if e.isList() {
+		return items[start:end], nil
+	}
+	return []string{strings.Join(items[start:end], "")}, nil
+}
+
+func emptyValues(e parameterExpansion) []string {
+	if e.isList() {
+		return nil
+	}
+	return []string{""}
+}
+
+func arithmeticOperand(text string, menu *builtInMenu) (int64, error) {
+	value, err := arithmeticExpansion(text, menu)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// transformValues applies the pattern operators, which remove a prefix or
+// suffix, replace matches or change case, to each value.
+func transformValues(e parameterExpansion, t Token, values []string, menu *builtInMenu) ([]string, error) {
+	patternText, replacementText := e.operand, ""
+	if strings.HasPrefix(e.op, "/") {
+		patternText, replacementText = splitReplacement(e.operand)
+	}
+	// The pattern is a pattern even inside double quotes; only quotes
+	// within it make characters match literally.
+	pattern, err := expandPattern(tokenizeOperand(patternText, false), menu)
+	if err != nil {
+		return nil, err
+	}
+	replacement, err := expandWord(tokenizeOperand(replacementText, t.quoted), menu)
+	if err != nil {
+		return nil, err
+	}
+
+	transformed := make([]string, len(values))
+	for i, v := range values {
+		switch e.op {
+		case "#", "##":
+			transformed[i] = removePrefix(v, pattern, e.op == "##")
+		case "%", "%%":
+			transformed[i] = removeSuffix(v, pattern, e.op == "%%")
+		case "/", "//", "/#", "/%":
+			transformed[i] = replacePattern(v, pattern, replacement, e.op)
+		case "^", "^^", ",", ",,":
+			transformed[i] = changeCase(v, pattern, e.op)
+		}
+	}
+	return transformed, nil
+}
+
+// splitReplacement splits the operand of ${x/pattern/string} at the first
+// slash that is neither quoted nor escaped.
+func splitReplacement(operand string) (string, string) {
+	var quote byte
+	for i := 0; i < len(operand); i++ {
+		switch ch := operand[i]; {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			} else if ch == '\\' && quote == '"' {
+				i++
+			}
+		case ch == '\\':
+			i++
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '/':
+			return operand[:i], operand[i+1:]
+		}
+	}
+	return operand, ""
+}
+
+func removePrefix(value string, pattern string, longest bool) string {
+	for n := 0; n <= len(value); n++ {
+		i := n
+		if longest {
+			i = len(value) - n
+		}
+		if matchPattern(pattern, value[:i]) {
+			return value[i:]
+		}
+	}
+	return value
+}
+
+func removeSuffix(value string, pattern string, longest bool) string {
+	for n := 0; n <= len(value); n++ {
+		i := len(value) - n
+		if longest {
+			i = n
+		}
+		if matchPattern(pattern, value[i:]) {
+			return value[:i]
+		}
+	}
+	return value
+}
+
+// replacePattern replaces the longest match of pattern by replacement: the
+// first match for /, every match for //, and only a match at the start or
+// end for /# and /%.
+func replacePattern(value string, pattern string, replacement string, op string) string {
+	switch op {
+	case "/#":
+		for i := len(value); i >= 0; i-- {
+			if matchPattern(pattern, value[:i]) {
+				return replacement + value[i:]
+			}
+		}
+		return value
+	case "/%":
+		for i := 0; i <= len(value); i++ {
+			if matchPattern(pattern, value[i:]) {
+				return value[:i] + replacement
+			}
+		}
+		return value
+	}
+
+	if pattern == "" {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); {
+		end := -1
+		for j := len(value); j > i; j-- {
+			if matchPattern(pattern, value[i:j]) {
+				end = j
+				break
+			}
+		}
+		if end < 0 {
+			b.WriteByte(value[i])
+			i++
+			continue
+		}
+		b.WriteString(replacement)
+		if op == "/" {
+			return b.String() + value[end:]
+		}
+		i = end
+	}
+	return b.String()
+}
+
+// changeCase converts the characters matching pattern, which defaults to
+// any character, to upper case for ^ and lower case for ,. The single
+// forms only consider the first character.
+func changeCase(value string, pattern string, op string) string {
+	if pattern == "" {
+		pattern = "?"
+	}
+	convert := unicode.ToUpper
+	if strings.HasPrefix(op, ",") {
+		convert = unicode.ToLower
+	}
+	runes := []rune(value)
+	for i, r := range runes {
+		if i > 0 && len(op) == 1 {
+			break
+		}
+		if matchPattern(pattern, string(r)) {
+			runes[i] = convert(r)
+		}
+	}
+	return string(runes)
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
 	"strings"
 )
 
@@ -18,18 +22,74 @@ const (
 	HOME        = "HOME"
 	REDIRECTION = "REDIRECTION"
 	PIPE = "PIPE"
+	VARIABLE    = "VARIABLE"
+	ASSIGN      = "ASSIGN"
+	SEMICOLON   = "SEMICOLON"
+	AND         = "AND"
+	OR          = "OR"
+	NEWLINE     = "NEWLINE"
+	BACKGROUND  = "BACKGROUND"
+	LPAREN      = "LPAREN"
+	RPAREN      = "RPAREN"
+	DSEMI       = "DSEMI"
+	COMMANDSUB  = "COMMANDSUB"
+	ARITHMETIC  = "ARITHMETIC"
+	DPAREN      = "DPAREN"
 )
 
 type Token struct {
-	tType   TokenType
-	literal string
+	tType    TokenType
+	literal  string
+	quoted   bool
+	position int
+	heredoc  *heredoc
+}
+
+// heredoc is filled in by the lexer once it reaches the end of the line that
+// introduced it and has consumed the body lines that follow.
+type heredoc struct {
+	delimiter string
+	quoted    bool
+	stripTabs bool
+	body      word
+	// text is the body as it appears in the input, delimiter line included,
+	// and offset is where it starts.
+	text   string
+	offset int
 }
 
 type Lexer struct {
-	input        string
-	position     int
-	readposition int
-	ch           byte
+	input            string
+	position         int
+	readposition     int
+	ch               byte
+	inDoubleQuote    bool
+	pendingExpansion bool
+	quoteStart       int
+	tokenStart       int
+	err              *syntaxError
+	pendingHeredocs  []*heredoc
+}
+
+// syntaxError describes input the parser could not accept. line and column
+// are 1-based and point at the offending token so the prompt can mark it.
+type syntaxError struct {
+	line    int
+	column  int
+	token   string
+	message string
+	// incomplete is set when more input lines could still complete the
+	// command, for example a here-document whose delimiter was not seen yet.
+	incomplete bool
+	// delimiter is set when that here-document is what is incomplete.
+	delimiter string
+}
+
+func (e *syntaxError) Error() string {
+	if e.message != "" {
+		return e.message
+	}
+	return fmt.Sprintf("syntax error near unexpected token `%s'", e.token)
 }
 
 func newLexer(i string) *Lexer {
@@ -48,33 +108,142 @@ func (l *Lexer) readChar() {
 	l.readposition++
 }
 
+// char is the byte at l.ch as a string. Bytes outside ASCII are kept as
+// they are, so multibyte characters go through the lexer unchanged.
+func (l *Lexer) char() string {
+	return l.input[l.position:l.readposition]
+}
+
+func (l *Lexer) peekChar() byte {
+	if l.readposition >= len(l.input) {
+		return 0
+	}
+	return l.input[l.readposition]
+}
+
 func (l *Lexer) nextToken() Token {
+	l.tokenStart = l.position
+	token := l.scanToken()
+	token.position = l.tokenStart
+	return token
+}
+
+func (l *Lexer) scanToken() Token {
 	var token Token
 
+	if l.inDoubleQuote {
+		return l.nextQuotedToken()
+	}
+
 	switch l.ch {
 	case '\'':
 		content := l.readSingleQuote()
-		token = newToken(STRING, content)
+		token = newQuotedToken(STRING, content)
 	case '"':
+		l.quoteStart = l.position
 		content := l.readDoubleQuote()
-		token = newToken(STRING, content)
-	case ' ':
+		token = newQuotedToken(STRING, content)
+		if l.inDoubleQuote {
+			if content == "" {
+				return l.nextQuotedToken()
+			}
+			return token
+		}
+	case '$':
+		if !l.startsExpansion() {
+			token = newToken(IDENT, "$")
+			break
+		}
+		token = l.readExpansion()
+	case '`':
+		token = newToken(COMMANDSUB, l.readBackquote(false))
+	case '=':
+		token = newToken(ASSIGN, "=")
+	case ' ', '\t':
 		token = newToken(SPACE, " ")
+	case '#':
+		if l.startsComment() {
+			for l.ch != '\n' && l.ch != 0 {
+				l.readChar()
+			}
+			return l.scanToken()
+		}
+		token = newToken(IDENT, "#")
 	case '.':
 		token = newToken(DOT, ".")
 	case '/':
 		token = newToken(FORWARD, "/")
 	case '\\':
+		if l.peekChar() == '\n' {
+			l.readChar()
+			l.readChar()
+			return l.scanToken()
+		}
 		content := l.readBackslash()
 		token = newToken(BACKWARD, content)
+	case '\n':
+		token = newToken(NEWLINE, "\n")
+		l.readHeredocBodies()
 	case '~':
 		token = newToken(HOME, "~")
 	case '>':
-		token = newToken(REDIRECTION, ">")
+		switch l.peekChar() {
+		case '>', '&', '|':
+			l.readChar()
+			token = newToken(REDIRECTION, ">"+string(l.ch))
+		default:
+			token = newToken(REDIRECTION, ">")
+		}
+	case '<':
+		op := l.readInputOperator()
+		token = newToken(REDIRECTION, op)
+		if op == "<<" || op == "<<-" {
+			token.heredoc = l.readHeredocDelimiter(op == "<<-")
+			return token
+		}
 	case '|':
+		if l.peekChar() == '|' {
+			l.readChar()
+			token = newToken(OR, "||")
+			break
+		}
 		token = newToken(PIPE, "|")
+	case '&':
+		switch l.peekChar() {
+		case '&':
+			l.readChar()
+			token = newToken(AND, "&&")
+		case '>':
+			l.readChar()
+			if l.peekChar() == '>' {
+				l.readChar()
+				token = newToken(REDIRECTION, "&>>")
+				break
+			}
+			token = newToken(REDIRECTION, "&>")
+		default:
+			token = newToken(BACKGROUND, "&")
+		}
+	case ';':
+		if l.peekChar() == ';' {
+			l.readChar()
+			token = newToken(DSEMI, ";;")
+			break
+		}
+		token = newToken(SEMICOLON, ";")
+	case '(':
+		if expr, ok := l.readArithmetic(l.position + 2); ok {
+			token = newToken(DPAREN, expr)
+			break
+		}
+		token = newToken(LPAREN, "(")
+	case ')':
+		token = newToken(RPAREN, ")")
 	case 0:
 		token = newToken(EOF, "")
+		if len(l.pendingHeredocs) > 0 {
+			l.readHeredocBodies()
+		}
 	default:
 		if isLiteral(l.ch) {
 			content := l.readIdentifier()
@@ -86,16 +255,448 @@ func (l *Lexer) nextToken() Token {
 			token = newToken(NUMBER, content)
 			return token
 		}
+		// Any other character has no special meaning and is part of a word.
+		token = newToken(IDENT, l.char())
+	}
+	l.readChar()
+	return token
+}
 
+// nextQuotedToken continues a double quoted string that was interrupted by a
+// parameter expansion or command substitution, so the expansion can be
+// resolved without word splitting.
+func (l *Lexer) nextQuotedToken() Token {
+	if l.pendingExpansion {
+		l.pendingExpansion = false
+		var token Token
+		if l.ch == '`' {
+			token = newToken(COMMANDSUB, l.readBackquote(true))
+		} else {
+			token = l.readExpansion()
+		}
+		token.quoted = true
+		return token
+	}
+	// The empty strings around an expansion are left out, so that "$@"
+	// without positional parameters is no word at all rather than "".
+	token := newQuotedToken(STRING, l.readDoubleQuote())
+	if l.inDoubleQuote {
+		if token.literal == "" {
+			return l.nextQuotedToken()
+		}
+		return token
 	}
 	l.readChar()
+	if token.literal == "" {
+		l.tokenStart = l.position
+		return l.scanToken()
+	}
 	return token
 }
 
+// startsComment reports whether the '#' at l.ch begins a word, which makes
+// it start a comment running to the end of the line.
+func (l *Lexer) startsComment() bool {
+	if l.position == 0 {
+		return true
+	}
+	return strings.IndexByte(" \t\n;&|<>()", l.input[l.position-1]) >= 0
+}
+
+// startsExpansion reports whether the '$' at l.ch starts a parameter
+// expansion or a command substitution rather than standing for itself.
+func (l *Lexer) startsExpansion() bool {
+	next := l.peekChar()
+	return next == '{' || next == '(' || isNameStart(next) || isDigit(next) || isSpecialParam(next)
+}
+
+// readExpansion expects l.ch to be a '$' that starts an expansion and leaves
+// l.ch on its last character.
+func (l *Lexer) readExpansion() Token {
+	if l.peekChar() == '(' {
+		if expr, ok := l.readArithmetic(l.position + 3); ok {
+			return newToken(ARITHMETIC, expr)
+		}
+		return newToken(COMMANDSUB, l.readCommandSubstitution())
+	}
+	return newToken(VARIABLE, l.readVariable())
+}
+
+// readCommandSubstitution expects l.ch to be the '$' of "$(" and leaves l.ch
+// on the matching ')'. It returns the command in between, which is lexed on
+// the way so that parentheses inside quotes or nested substitutions do not
+// end it early.
+func (l *Lexer) readCommandSubstitution() string {
+	dollar := l.position
+	start := l.position + 2
+	sub := newLexer(l.input[start:])
+	depth := 0
+	for {
+		t := sub.nextToken()
+		switch {
+		case sub.err != nil || t.tType == EOF:
+			l.unterminated(dollar+1, ")")
+			l.readposition = len(l.input)
+			l.readChar()
+			return l.input[start:]
+		case t.tType == LPAREN:
+			depth++
+		case t.tType == RPAREN && depth > 0:
+			depth--
+		case t.tType == RPAREN:
+			end := start + t.position
+			l.readposition = end
+			l.readChar()
+			return l.input[start:end]
+		}
+	}
+}
+
+// readArithmetic reads the expression of a $(( )) expansion or a (( ))
+// command, which starts at start with l.ch on the last opening parenthesis
+// before it, and leaves l.ch on the closing "))". It reports false, reading
+// nothing, when the parentheses are not closed by "))", which makes them a
+// command substitution or subshell starting with a subshell instead.
+func (l *Lexer) readArithmetic(start int) (string, bool) {
+	if start > len(l.input) || l.input[start-2:start] != "((" {
+		return "", false
+	}
+	depth := 0
+	for i := start; i < len(l.input); i++ {
+		switch l.input[i] {
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+				continue
+			}
+			if i+1 == len(l.input) || l.input[i+1] != ')' {
+				return "", false
+			}
+			l.readposition = i + 1
+			l.readChar()
+			return l.input[start:i], true
+		}
+	}
+	return "", false
+}
+
+// readBackquote expects l.ch to be an opening backquote and leaves l.ch on
+// the closing one. It returns the command in between, where a backslash
+// only escapes $, ` and \, and " too when the substitution is inside
+// double quotes.
+func (l *Lexer) readBackquote(inDoubleQuote bool) string {
+	start := l.position
+	var b strings.Builder
+	for {
+		l.readChar()
+		switch {
+		case l.ch == 0:
+			l.unterminated(start, "`")
+			return b.String()
+		case l.ch == '`':
+			return b.String()
+		case l.ch == '\\' && (strings.IndexByte("$`\\", l.peekChar()) >= 0 || inDoubleQuote && l.peekChar() == '"'):
+			l.readChar()
+		}
+		b.WriteByte(l.ch)
+	}
+}
+
+// readVariable expects l.ch to be '$' and leaves l.ch on the last character
+// of the parameter reference.
+func (l *Lexer) readVariable() string {
+	next := l.peekChar()
+	switch {
+	case next == '{':
+		l.readChar()
+		position := l.position + 1
+		l.skipBraced()
+		if l.ch == 0 {
+			l.unterminated(position-2, "}")
+		}
+		return l.input[position:l.position]
+	case isDigit(next) || isSpecialParam(next):
+		l.readChar()
+		return string(l.ch)
+	default:
+		l.readChar()
+		position := l.position
+		for isNameChar(l.peekChar()) {
+			l.readChar()
+		}
+		return l.input[position:l.readposition]
+	}
+}
+
+// skipBraced moves l.ch from the '{' of a ${...} expansion to the '}' that
+// closes it, passing over quotes, escapes and nested expansions whose text
+// may contain a '}' of its own.
+func (l *Lexer) skipBraced() {
+	for {
+		l.readChar()
+		switch {
+		case l.ch == 0 || l.ch == '}':
+			return
+		case l.ch == '\\' && l.peekChar() != 0:
+			l.readChar()
+		case l.ch == '\'' && !l.inDoubleQuote:
+			l.readSingleQuote()
+		case l.ch == '"':
+			l.readChar()
+			for l.ch != 0 && l.ch != '"' {
+				if l.ch == '\\' && l.peekChar() != 0 {
+					l.readChar()
+				}
+				l.readChar()
+			}
+		case l.ch == '`':
+			l.readBackquote(false)
+		case l.ch == '$' && l.peekChar() == '(':
+			l.readExpansion()
+		case l.ch == '$' && l.peekChar() == '{':
+			l.readChar()
+			l.skipBraced()
+		}
+		if l.ch == 0 {
+			return
+		}
+	}
+}
+
+// readInputOperator expects l.ch to be '<' and reads the longest input
+// redirection operator starting there.
+func (l *Lexer) readInputOperator() string {
+	switch l.peekChar() {
+	case '>':
+		l.readChar()
+		return "<>"
+	case '&':
+		l.readChar()
+		return "<&"
+	case '<':
+		l.readChar()
+		switch l.peekChar() {
+		case '<':
+			l.readChar()
+			return "<<<"
+		case '-':
+			l.readChar()
+			return "<<-"
+		}
+		return "<<"
+	}
+	return "<"
+}
+
+// readHeredocDelimiter expects l.ch to be the last character of a << or <<-
+// operator. It reads the delimiter word, removing its quotes, and queues the
+// here-document so its body is read after the current line.
+func (l *Lexer) readHeredocDelimiter(stripTabs bool) *heredoc {
+	h := &heredoc{stripTabs: stripTabs}
+	l.readChar()
+	for l.ch == ' ' || l.ch == '\t' {
+		l.readChar()
+	}
+
+	var delimiter strings.Builder
+	for l.ch != 0 && strings.IndexByte(" \t\n;|&<>()", l.ch) < 0 {
+		switch l.ch {
+		case '\'', '"':
+			quote := l.ch
+			h.quoted = true
+			l.readChar()
+			for l.ch != 0 && l.ch != quote {
+				delimiter.WriteByte(l.ch)
+				l.readChar()
+			}
+		case '\\':
+			h.quoted = true
+			l.readChar()
+			if l.ch != 0 {
+				delimiter.WriteByte(l.ch)
+			}
+		default:
+			delimiter.WriteByte(l.ch)
+		}
+		if l.ch != 0 {
+			l.readChar()
+		}
+	}
+	h.delimiter = delimiter.String()
+	if h.delimiter != "" || h.quoted {
+		l.pendingHeredocs = append(l.pendingHeredocs, h)
+	}
+	return h
+}
+
+// readHeredocBodies expects l.ch to be a newline. It consumes the body lines
+// of every here-document started on the line that just ended, leaving the
+// lexer on the last character of the final delimiter line.
+func (l *Lexer) readHeredocBodies() {
+	position := l.readposition
+	for _, h := range l.pendingHeredocs {
+		start := position
+		lines := []string{}
+		found := false
+		for position < len(l.input) {
+			line := l.input[position:]
+			next := len(l.input)
+			if end := strings.IndexByte(line, '\n'); end >= 0 {
+				line = line[:end]
+				next = position + end + 1
+			}
+			position = next
+			if h.stripTabs {
+				line = strings.TrimLeft(line, "\t")
+			}
+			if line == h.delimiter {
+				found = true
+				break
+			}
+			lines = append(lines, line)
+		}
+
+		body := strings.Join(lines, "\n")
+		if len(lines) > 0 {
+			body += "\n"
+		}
+		h.body = tokenizeHeredoc(body, h.quoted)
+		start, end := min(start, len(l.input)), min(position, len(l.input))
+		h.text, h.offset = l.input[start:end], start
+		if !found && l.err == nil {
+			l.err = &syntaxError{
+				line:       lineAt(l.input, l.position),
+				column:     columnAt(l.input, l.position),
+				token:      h.delimiter,
+				message:    fmt.Sprintf("here-document delimited by end-of-file (wanted `%s')", h.delimiter),
+				incomplete: true,
+				delimiter:  h.delimiter,
+			}
+		}
+	}
+	l.pendingHeredocs = nil
+	l.readposition = position
+	if l.readposition > l.position+1 {
+		l.position = l.readposition - 1
+		l.ch = l.input[l.position]
+	}
+}
+
+// tokenizeHeredoc turns a here-document body into a quoted word. Unless the
+// delimiter was quoted, parameter references inside it are expanded and a
+// backslash only escapes $, `, \ and newline, as in bash.
+func tokenizeHeredoc(body string, quoted bool) word {
+	if quoted {
+		return word{parts: []Token{newQuotedToken(STRING, body)}}
+	}
+
+	w := word{}
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			w.parts = append(w.parts, newQuotedToken(STRING, text.String()))
+			text.Reset()
+		}
+	}
+
+	l := newLexer(body)
+	for l.ch != 0 {
+		switch {
+		case l.ch == '\\' && l.peekChar() != 0 && strings.IndexByte("$`\\\n", l.peekChar()) >= 0:
+			l.readChar()
+			if l.ch != '\n' {
+				text.WriteByte(l.ch)
+			}
+		case l.ch == '$' && l.startsExpansion():
+			flush()
+			token := l.readExpansion()
+			token.quoted = true
+			w.parts = append(w.parts, token)
+		case l.ch == '`':
+			flush()
+			w.parts = append(w.parts, newQuotedToken(COMMANDSUB, l.readBackquote(false)))
+		default:
+			text.WriteByte(l.ch)
+		}
+		l.readChar()
+	}
+	flush()
+	if len(w.parts) == 0 {
+		w.parts = append(w.parts, newQuotedToken(STRING, ""))
+	}
+	return w
+}
+
+// tokenizeOperand turns the word inside a ${...} expansion, such as the
+// default of ${var:-word}, into a word of its own. Quotes, backslashes and
+// expansions in it work as they do anywhere else, and all of it is quoted
+// when the expansion itself is.
+func tokenizeOperand(text string, quoted bool) word {
+	w := word{}
+	var literal strings.Builder
+	flush := func() {
+		if literal.Len() > 0 {
+			w.parts = append(w.parts, Token{tType: STRING, literal: literal.String(), quoted: quoted})
+			literal.Reset()
+		}
+	}
+
+	l := newLexer(text)
+	for l.ch != 0 {
+		switch {
+		case l.ch == '\\' && l.peekChar() != 0 && (!quoted || strings.IndexByte("$`\"\\}", l.peekChar()) >= 0):
+			flush()
+			l.readChar()
+			w.parts = append(w.parts, Token{tType: BACKWARD, literal: l.char(), quoted: quoted})
+		case l.ch == '\'' && !quoted:
+			flush()
+			w.parts = append(w.parts, newQuotedToken(STRING, l.readSingleQuote()))
+		case l.ch == '"':
+			flush()
+			l.quoteStart = l.position
+			w.parts = append(w.parts, l.nextToken())
+			for l.inDoubleQuote {
+				w.parts = append(w.parts, l.nextToken())
+			}
+			continue
+		case l.ch == '$' && l.startsExpansion():
+			flush()
+			token := l.readExpansion()
+			token.quoted = quoted
+			w.parts = append(w.parts, token)
+		case l.ch == '`':
+			flush()
+			w.parts = append(w.parts, Token{tType: COMMANDSUB, literal: l.readBackquote(quoted), quoted: quoted})
+		default:
+			literal.WriteByte(l.ch)
+		}
+		l.readChar()
+	}
+	flush()
+	return w
+}
+
+// unterminated records the first quote or brace left open in the input.
+func (l *Lexer) unterminated(position int, delimiter string) {
+	if l.err != nil {
+		return
+	}
+	l.err = &syntaxError{
+		line:    lineAt(l.input, position),
+		column:  columnAt(l.input, position),
+		token:   delimiter,
+		message: fmt.Sprintf("unexpected EOF while looking for matching `%s'", delimiter),
+		// A quote or brace can still be closed on a later line.
+		incomplete: true,
+	}
+}
+
 func (l *Lexer) readBackslash() string {
 	l.readChar()
 	if l.ch != 0 {
-		return string(l.input[l.position])
+		return l.char()
 	}
 	return ""
 }
@@ -120,7 +721,11 @@ func (l *Lexer) readSingleQuote() string {
 	position := l.position + 1
 	for {
 		l.readChar()
-		if l.ch == 0 || l.ch == '\'' {
+		if l.ch == 0 {
+			l.unterminated(position-1, "'")
+			break
+		}
+		if l.ch == '\'' {
 			break
 		}
 	}
@@ -131,7 +736,16 @@ func (l *Lexer) readDoubleQuote() string {
 	selectedStrings := []string{}
 	for {
 		l.readChar()
+		if l.ch == 0 {
+			l.unterminated(l.quoteStart, "\"")
+		}
 		if l.ch == 0 || l.ch == '"' {
+			l.inDoubleQuote = false
+			break
+		}
+		if (l.ch == '$' && l.startsExpansion()) || l.ch == '`' {
+			l.inDoubleQuote = true
+			l.pendingExpansion = true
 			break
 		}
 		if l.ch == '\\' {
@@ -143,11 +757,14 @@ func (l *Lexer) readDoubleQuote() string {
 			case '"':
 				selectedStrings = append(selectedStrings, "\"")
 				continue
+			case '$', '`':
+				selectedStrings = append(selectedStrings, string(l.ch))
+				continue
 			default:
 				selectedStrings = append(selectedStrings, "\\")
 			}
 		}
-		selectedStrings = append(selectedStrings, string(l.ch))
+		selectedStrings = append(selectedStrings, l.char())
 	}
 	return strings.Join(selectedStrings, "")
 }
@@ -167,103 +784,820 @@ func newToken(t TokenType, l string) Token {
 	return Token{tType: t, literal: l}
 }
 
-func parseInput(i string) ([]commandReceived, bool) {
-	parts := []Token{}
+func newQuotedToken(t TokenType, l string) Token {
+	return Token{tType: t, literal: l, quoted: true}
+}
+
+type parser struct {
+	input    string
+	tokens   []Token
+	position int
+	// aliases maps alias names to their text. It is nil when aliases are
+	// not expanded, as in scripts.
+	aliases map[string]string
+	// aliasEnd is the index of the word following the text of an alias that
+	// ended in a blank, which is checked for an alias as well.
+	aliasEnd int
+}
+
+func parseInput(i string, aliases map[string]string) (*commandList, error) {
+	p, err := newParser(i, aliases)
+	if err != nil {
+		return nil, err
+	}
+	return p.parseList()
+}
+
+// newParser splits the input into tokens, ready to be parsed.
+func newParser(i string, aliases map[string]string) (*parser, error) {
 	l := newLexer(i)
-	currentToken := l.nextToken()
-	hasPipeline := false
-	for currentToken.tType != EOF {
-		if currentToken.tType == PIPE {
-			hasPipeline = true
+	p := &parser{input: i, aliases: aliases, aliasEnd: -1}
+	for {
+		t := l.nextToken()
+		p.tokens = append(p.tokens, t)
+		if t.tType == EOF {
+			break
 		}
-		parts = append(parts, currentToken)
-		currentToken = l.nextToken()
 	}
+	if l.err != nil {
+		return nil, l.err
+	}
+	return p, nil
+}
 
-	if len(parts) == 0 {
-		return nil, false
+func (p *parser) current() Token {
+	return p.tokens[p.position]
+}
+
+func (p *parser) advance() {
+	if p.position < len(p.tokens)-1 {
+		p.position++
 	}
+}
 
-	start := 0
-	end := 0
-	commands := []commandReceived{}
+// unexpected reports the current token as a syntax error, naming the end of
+// the input "newline" the way bash does.
+func (p *parser) unexpected() *syntaxError {
+	t := p.current()
+	literal := t.literal
+	if t.tType == EOF {
+		literal = "newline"
+	}
+	return &syntaxError{line: lineAt(p.input, t.position), column: columnAt(p.input, t.position), token: literal}
+}
 
-	for start < len(parts) && end < len(parts) {
-		currentToken := parts[end]
-		if currentToken.tType == PIPE {
-			parsedCommand := parseCommand(parts[start:end])
-			commands = append(commands, parsedCommand)
-			start = end + 1
-			end = start
+// lineAt converts an offset into the input to a 1-based line number.
+func lineAt(input string, position int) int {
+	if position > len(input) {
+		position = len(input)
+	}
+	return strings.Count(input[:position], "\n") + 1
+}
+
+// columnAt converts an offset into the input to a 1-based column within its
+// line.
+func columnAt(input string, position int) int {
+	if position > len(input) {
+		position = len(input)
+	}
+	return position - strings.LastIndexByte(input[:position], '\n')
+}
+
+func (p *parser) skipSpaces() {
+	for p.current().tType == SPACE {
+		p.advance()
+	}
+}
+
+// skipBlank also skips line breaks, which are allowed after operators that
+// need a following command such as && or |.
+func (p *parser) skipBlank() {
+	for p.current().tType == SPACE || p.current().tType == NEWLINE {
+		p.advance()
+	}
+}
+
+// parseList parses commands up to the end of the input or, when terminators
+// are given, up to the first of them in command position: a reserved word
+// such as the fi closing an if, or one of the ) and ;; operators. Running
+// out of input before a terminator leaves the list incomplete.
+func (p *parser) parseList(terminators ...string) (*commandList, error) {
+	list := &commandList{}
+	var operator TokenType
+	for {
+		p.skipSpaces()
+		if operator != "" {
+			p.skipBlank()
+		}
+		if p.current().tType == EOF {
+			if len(terminators) > 0 {
+				return nil, p.unexpectedEnd()
+			}
+			if operator != "" {
+				return nil, p.unexpected()
+			}
+			return list, nil
+		}
+		if p.atTerminator(terminators) {
+			if operator != "" {
+				return nil, p.unexpected()
+			}
+			return list, nil
+		}
+		if p.current().tType == SEMICOLON || p.current().tType == NEWLINE {
+			p.advance()
+			continue
+		}
+
+		pl, err := p.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		entry := listEntry{operator: operator, pipeline: pl}
+
+		operator = ""
+		switch p.current().tType {
+		case SEMICOLON, NEWLINE:
+			p.advance()
+		case BACKGROUND:
+			entry.background = true
+			p.advance()
+		case AND, OR:
+			operator = p.current().tType
+			p.advance()
+		}
+		list.entries = append(list.entries, entry)
+	}
+}
+
+func (p *parser) parsePipeline() (*pipeline, error) {
+	p.skipSpaces()
+	pl := &pipeline{line: lineAt(p.input, p.current().position)}
+	for {
+		p.skipSpaces()
+		start := p.position
+		command, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		pl.commands = append(pl.commands, command)
+		pl.sources = append(pl.sources, p.sourceSince(start))
+		if p.current().tType != PIPE {
+			return pl, nil
 		}
-		end += 1
+		p.advance()
+		p.skipBlank()
 	}
+}
 
-	if start < len(parts) {
-		parsedCommand := parseCommand(parts[start:])
-		commands = append(commands, parsedCommand)
+// sourceSince returns the input from the token at start up to the current
+// one, followed by the bodies of the here-documents that it opens but that
+// lie beyond it, so that the text can be parsed again on its own.
+func (p *parser) sourceSince(start int) string {
+	end := p.current().position
+	text := strings.TrimSpace(p.input[p.tokens[start].position:end])
+	for _, t := range p.tokens[start:p.position] {
+		if t.heredoc != nil && t.heredoc.offset >= end {
+			text += "\n" + t.heredoc.text
+		}
 	}
+	return text
+}
 
-	return commands, hasPipeline
+// atTerminator reports whether the current token is one of terminators.
+func (p *parser) atTerminator(terminators []string) bool {
+	switch p.current().tType {
+	case RPAREN:
+		return slices.Contains(terminators, ")")
+	case DSEMI:
+		return slices.Contains(terminators, ";;")
+	}
+	return p.atReservedWord(terminators...)
 }
 
+func (p *parser) parseCommand() (commandNode, error) {
+	p.skipSpaces()
+	if p.atCompound() {
+		return p.parseCompound()
+	}
+	if p.atReservedWord("}", "then", "elif", "else", "fi", "do", "done", "esac") {
+		return nil, p.unexpected()
+	}
+	start := p.current().position
+	if name, ok := p.functionName(); ok {
+		return p.parseFunction(name, start)
+	}
 
-func parseCommand(parts []Token) commandReceived {
-	var firstSpaceIndex int
-	commandLiteral := ""
-	for j, t := range parts {
-		if j == 0 && t.tType == SPACE {
+	command := &simpleCommand{}
+	expanded := map[string]bool{}
+	for {
+		p.skipSpaces()
+		t := p.current()
+		if isCommandTerminator(t.tType) {
+			break
+		}
+		if !isWordToken(t.tType) && t.tType != REDIRECTION {
+			return nil, p.unexpected()
+		}
+
+		if t.tType == REDIRECTION {
+			r, err := p.parseRedirection(-1)
+			if err != nil {
+				return nil, err
+			}
+			command.redirections = append(command.redirections, r)
+			continue
+		}
+
+		if (len(command.words) == 0 || p.position == p.aliasEnd) && p.expandAlias(expanded) {
+			continue
+		}
+
+		w := p.parseWord()
+		if p.current().tType == REDIRECTION && isFdPrefix(w) {
+			r, err := p.parseRedirection(atoi(w.parts[0].literal))
+			if err != nil {
+				return nil, err
+			}
+			command.redirections = append(command.redirections, r)
 			continue
 		}
-		if t.tType == SPACE {
-			firstSpaceIndex = j
+
+		if len(command.words) == 0 {
+			if a, ok := parseAssignment(w); ok {
+				if p.startsArray(a) {
+					var err error
+					a.array = true
+					if a.elements, _, err = p.parseArrayElements(); err != nil {
+						return nil, err
+					}
+				}
+				command.assignments = append(command.assignments, a)
+				continue
+			}
+		}
+		// declare arr=( ... ) passes the array as text, which the builtin
+		// parses again.
+		if a, ok := parseAssignment(w); ok && isDeclaration(command) && p.startsArray(a) {
+			start := p.current().position
+			_, end, err := p.parseArrayElements()
+			if err != nil {
+				return nil, err
+			}
+			w.parts = append(w.parts, newQuotedToken(STRING, p.input[start:end]))
+		}
+		command.words = append(command.words, w)
+	}
+
+	empty := len(command.words) == 0 && len(command.assignments) == 0 && len(command.redirections) == 0
+	if empty && len(expanded) == 0 {
+		return nil, p.unexpected()
+	}
+	return command, nil
+}
+
+// expandAlias replaces the word at the current position with the tokens of
+// the alias it names. Only words of plain unquoted text are looked up, and
+// an alias is not expanded again within the same command, which stops
+// aliases like ls='ls -F' from recursing. An alias whose text ends in a
+// blank has the word after it checked too.
+func (p *parser) expandAlias(expanded map[string]bool) bool {
+	if p.aliases == nil {
+		return false
+	}
+	start, end := p.position, p.position
+	name := ""
+	for end < len(p.tokens) && isWordToken(p.tokens[end].tType) {
+		t := p.tokens[end]
+		if t.quoted || t.tType == VARIABLE || t.tType == COMMANDSUB || t.tType == ARITHMETIC || t.heredoc != nil {
+			return false
+		}
+		name += t.literal
+		end++
+	}
+	value, ok := p.aliases[name]
+	if !ok || expanded[name] {
+		return false
+	}
+	expanded[name] = true
+
+	replacement := []Token{}
+	l := newLexer(value)
+	for t := l.nextToken(); t.tType != EOF; t = l.nextToken() {
+		t.position = p.tokens[start].position
+		replacement = append(replacement, t)
+	}
+	tokens := append(slices.Clone(p.tokens[:start]), replacement...)
+	p.tokens = append(tokens, p.tokens[end:]...)
+
+	if p.aliasEnd >= end {
+		p.aliasEnd += len(replacement) - (end - start)
+	}
+	if strings.HasSuffix(value, " ") || strings.HasSuffix(value, "\t") {
+		next := start + len(replacement)
+		for next < len(p.tokens) && p.tokens[next].tType == SPACE {
+			next++
+		}
+		p.aliasEnd = next
+	}
+	return true
+}
+
+// functionName reports whether the input at the current position starts a
+// function definition, name followed by (), and returns the name.
+func (p *parser) functionName() (string, bool) {
+	start := p.position
+	name, ok := p.parseName()
+	if !ok {
+		p.position = start
+		return "", false
+	}
+	end := p.position
+	p.position = start
+	for _, want := range []TokenType{LPAREN, RPAREN} {
+		for end < len(p.tokens) && p.tokens[end].tType == SPACE {
+			end++
+		}
+		if end == len(p.tokens) || p.tokens[end].tType != want {
+			return "", false
+		}
+		end++
+	}
+	p.position = end
+	return name, true
+}
+
+// parseName reads a word that is a valid variable or function name, written
+// without quotes.
+func (p *parser) parseName() (string, bool) {
+	name := ""
+	for isWordToken(p.current().tType) {
+		t := p.current()
+		if t.quoted || (t.tType != IDENT && t.tType != NUMBER) {
+			return "", false
+		}
+		name += t.literal
+		p.advance()
+	}
+	return name, isValidName(name)
+}
+
+// parseFunction parses the body of a function definition whose name and
+// parentheses were already consumed. The body is a compound command,
+// usually a { ...; } group. start is where the definition began.
+func (p *parser) parseFunction(name string, start int) (commandNode, error) {
+	p.skipBlank()
+	if p.current().tType == EOF {
+		return nil, p.unexpectedEnd()
+	}
+	if !p.atCompound() {
+		return nil, p.unexpected()
+	}
+	body, err := p.parseCompound()
+	if err != nil {
+		return nil, err
+	}
+	source := strings.TrimSpace(p.input[start:p.current().position])
+	return &functionDefinition{name: name, body: body, source: source}, nil
+}
+
+// atCompound reports whether the current token starts a compound command.
+func (p *parser) atCompound() bool {
+	t := p.current().tType
+	return t == LPAREN || t == DPAREN || p.atReservedWord("{", "if", "while", "until", "for", "case")
+}
+
+// parseCompound parses a compound command starting at the current token,
+// followed by its redirections.
+func (p *parser) parseCompound() (compoundNode, error) {
+	var node compoundNode
+	var err error
+	switch keyword := p.current().literal; {
+	case p.current().tType == LPAREN:
+		node, err = p.parseSubshell()
+	case p.current().tType == DPAREN:
+		node = &arithmeticCommand{expr: p.current().literal}
+		p.advance()
+	case keyword == "{":
+		p.advance()
+		group := &braceGroup{}
+		group.body, err = p.parseBody("}")
+		node = group
+	case keyword == "if":
+		node, err = p.parseIf()
+	case keyword == "while", keyword == "until":
+		p.advance()
+		l := &loop{until: keyword == "until"}
+		if l.condition, err = p.parseBody("do"); err == nil {
+			l.body, err = p.parseBody("done")
+		}
+		node = l
+	case keyword == "for":
+		node, err = p.parseFor()
+	case keyword == "case":
+		node, err = p.parseCase()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		p.skipSpaces()
+		fd := -1
+		if t := p.current(); t.tType == NUMBER && !t.quoted && p.tokens[p.position+1].tType == REDIRECTION {
+			fd = atoi(t.literal)
+			p.advance()
+		}
+		if p.current().tType != REDIRECTION {
 			break
 		}
-		commandLiteral += t.literal
+		r, err := p.parseRedirection(fd)
+		if err != nil {
+			return nil, err
+		}
+		node.addRedirection(r)
+	}
+	if !isCommandTerminator(p.current().tType) {
+		return nil, p.unexpected()
+	}
+	return node, nil
+}
+
+// parseBody parses a list that must not be empty, up to and including the
+// reserved word that ends it.
+func (p *parser) parseBody(terminators ...string) (*commandList, error) {
+	list, err := p.parseList(terminators...)
+	if err != nil {
+		return nil, err
+	}
+	if len(list.entries) == 0 {
+		return nil, p.unexpected()
+	}
+	p.advance()
+	return list, nil
+}
+
+func (p *parser) parseSubshell() (*subshell, error) {
+	open := p.current().position
+	p.advance()
+	body, err := p.parseBody(")")
+	if err != nil {
+		return nil, err
+	}
+	end := p.tokens[p.position-1].position
+	return &subshell{body: body, source: p.input[open+1 : end]}, nil
+}
+
+func (p *parser) parseIf() (*ifCommand, error) {
+	c := &ifCommand{}
+	for p.atReservedWord("if", "elif") {
+		p.advance()
+		condition, err := p.parseBody("then")
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.parseList("elif", "else", "fi")
+		if err != nil {
+			return nil, err
+		}
+		if len(body.entries) == 0 {
+			return nil, p.unexpected()
+		}
+		c.clauses = append(c.clauses, conditional{condition: condition, body: body})
 	}
-	if firstSpaceIndex == 0 {
-		return commandReceived{
-			command: commandLiteral,
-			params: nil,
+	if p.atReservedWord("else") {
+		p.advance()
+		body, err := p.parseList("fi")
+		if err != nil {
+			return nil, err
+		}
+		if len(body.entries) == 0 {
+			return nil, p.unexpected()
 		}
+		c.elseBody = body
 	}
-	cleanedParts := parts[firstSpaceIndex:]
-	if len(cleanedParts) < 1 {
-		return commandReceived{
-			command: commandLiteral,
-			params: nil,
+	p.advance()
+	return c, nil
+}
+
+// parseFor parses "for name [in words...]; do list; done".
+func (p *parser) parseFor() (*forLoop, error) {
+	p.advance()
+	p.skipSpaces()
+	if p.current().tType == EOF {
+		return nil, p.unexpectedEnd()
+	}
+	start := p.position
+	name, ok := p.parseName()
+	if !ok {
+		p.position = start
+		err := p.unexpected()
+		if isWordToken(p.current().tType) {
+			err.message = fmt.Sprintf("`%s': not a valid identifier", p.parseWord())
+		}
+		return nil, err
+	}
+	f := &forLoop{name: name, positional: true}
+	p.skipSpaces()
+	if p.atReservedWord("in") {
+		p.advance()
+		f.positional = false
+		for {
+			p.skipSpaces()
+			if !isWordToken(p.current().tType) {
+				break
+			}
+			f.words = append(f.words, p.parseWord())
+		}
+		if p.current().tType != SEMICOLON && p.current().tType != NEWLINE {
+			if p.current().tType == EOF {
+				return nil, p.unexpectedEnd()
+			}
+			return nil, p.unexpected()
 		}
 	}
+	if p.current().tType == SEMICOLON || p.current().tType == NEWLINE {
+		p.advance()
+	}
+	if err := p.expectReservedWord("do"); err != nil {
+		return nil, err
+	}
+	body, err := p.parseBody("done")
+	if err != nil {
+		return nil, err
+	}
+	f.body = body
+	return f, nil
+}
 
-	result := []string{}
-	var previousType TokenType
-	for i, t := range cleanedParts {
-		switch t.tType {
-		case SPACE:
-			if i == 0 {
-				continue
+// parseCase parses "case word in [(]pattern[|pattern]...) list;; ... esac".
+func (p *parser) parseCase() (*caseCommand, error) {
+	p.advance()
+	p.skipSpaces()
+	if p.current().tType == EOF {
+		return nil, p.unexpectedEnd()
+	}
+	if !isWordToken(p.current().tType) {
+		return nil, p.unexpected()
+	}
+	c := &caseCommand{subject: p.parseWord()}
+	if err := p.expectReservedWord("in"); err != nil {
+		return nil, err
+	}
+
+	for {
+		p.skipBlank()
+		if p.current().tType == EOF {
+			return nil, p.unexpectedEnd()
+		}
+		if p.atReservedWord("esac") {
+			p.advance()
+			return c, nil
+		}
+		if p.current().tType == LPAREN {
+			p.advance()
+			p.skipSpaces()
+		}
+
+		item := caseItem{}
+		for {
+			if !isWordToken(p.current().tType) {
+				return nil, p.unexpected()
 			}
-			if previousType != SPACE {
-				result = append(result, t.literal)
+			item.patterns = append(item.patterns, p.parseWord())
+			p.skipSpaces()
+			if p.current().tType != PIPE {
+				break
 			}
-			previousType = t.tType
-		case REDIRECTION:
-			if previousType == NUMBER || previousType == REDIRECTION {
-				result[len(result)-1] = result[len(result)-1] + t.literal
-				previousType = t.tType
-				continue
+			p.advance()
+			p.skipSpaces()
+		}
+		if p.current().tType != RPAREN {
+			return nil, p.unexpected()
+		}
+		p.advance()
+
+		body, err := p.parseList(";;", "esac")
+		if err != nil {
+			return nil, err
+		}
+		item.body = body
+		c.items = append(c.items, item)
+		if p.current().tType == DSEMI {
+			p.advance()
+		}
+	}
+}
+
+// expectReservedWord skips blank lines and consumes word, which has to come
+// next.
+func (p *parser) expectReservedWord(word string) error {
+	p.skipBlank()
+	if p.current().tType == EOF {
+		return p.unexpectedEnd()
+	}
+	if !p.atReservedWord(word) {
+		return p.unexpected()
+	}
+	p.advance()
+	return nil
+}
+
+// atReservedWord reports whether the current token is one of words written
+// as a word of its own. Reserved words are only recognised unquoted and in
+// command position, which is up to the callers.
+func (p *parser) atReservedWord(words ...string) bool {
+	t := p.current()
+	if t.tType != IDENT || t.quoted || !slices.Contains(words, t.literal) {
+		return false
+	}
+	return p.position+1 < len(p.tokens) && !isWordToken(p.tokens[p.position+1].tType)
+}
+
+// unexpectedEnd reports input that ended inside a construct, which more
+// lines could still complete.
+func (p *parser) unexpectedEnd() *syntaxError {
+	t := p.current()
+	return &syntaxError{
+		line:       lineAt(p.input, t.position),
+		column:     columnAt(p.input, t.position),
+		token:      "newline",
+		message:    "syntax error: unexpected end of file",
+		incomplete: true,
+	}
+}
+
+func (p *parser) parseRedirection(fd int) (redirection, error) {
+	op := p.current().literal
+	if h := p.current().heredoc; h != nil {
+		p.advance()
+		if h.delimiter == "" && !h.quoted {
+			return redirection{}, p.unexpected()
+		}
+		return redirection{fd: fd, op: op, target: h.body, delimiter: h.delimiter}, nil
+	}
+	p.advance()
+	p.skipSpaces()
+	if !isWordToken(p.current().tType) {
+		return redirection{}, p.unexpected()
+	}
+	return redirection{fd: fd, op: op, target: p.parseWord()}, nil
+}
+
+// parseWord collects the tokens up to the next space or operator into a
+// single word.
+func (p *parser) parseWord() word {
+	w := word{}
+	for isWordToken(p.current().tType) {
+		w.parts = append(w.parts, p.current())
+		p.advance()
+	}
+	return w
+}
+
+func isWordToken(t TokenType) bool {
+	switch t {
+	case SPACE, EOF, PIPE, SEMICOLON, AND, OR, REDIRECTION, NEWLINE, BACKGROUND, LPAREN, RPAREN, DSEMI, DPAREN:
+		return false
+	}
+	return true
+}
+
+func isCommandTerminator(t TokenType) bool {
+	switch t {
+	case EOF, PIPE, SEMICOLON, AND, OR, NEWLINE, BACKGROUND, RPAREN, DSEMI:
+		return true
+	}
+	return false
+}
+
+func isFdPrefix(w word) bool {
+	return len(w.parts) == 1 && w.parts[0].tType == NUMBER && !w.parts[0].quoted
+}
+
+// parseAssignment recognises NAME=value and NAME[subscript]=value words.
+// The name has to be written literally, so $X=1 or "X"=1 are plain words.
+func parseAssignment(w word) (assignmentNode, bool) {
+	nameEnd := 0
+	name := ""
+	for nameEnd < len(w.parts) && !isPlainText(w.parts[nameEnd], "[") && !w.parts[nameEnd].quoted && (w.parts[nameEnd].tType == IDENT || w.parts[nameEnd].tType == NUMBER) {
+		name += w.parts[nameEnd].literal
+		nameEnd++
+	}
+	if !isValidName(name) {
+		return assignmentNode{}, false
+	}
+	a := assignmentNode{name: name}
+	valueStart := nameEnd + 1
+	if nameEnd < len(w.parts) && isPlainText(w.parts[nameEnd], "[") {
+		subscript, next, ok := splitSubscript(w.parts[nameEnd:])
+		if !ok {
+			return assignmentNode{}, false
+		}
+		a.subscript = &subscript
+		valueStart = nameEnd + next
+	} else if nameEnd == len(w.parts) || w.parts[nameEnd].tType != ASSIGN {
+		return assignmentNode{}, false
+	}
+	a.value = word{parts: w.parts[valueStart:]}
+	return a, true
+}
+
+// splitSubscript splits the [subscript]= that parts start with off a word.
+// It returns the subscript and the index of the first part after the =.
+func splitSubscript(parts []Token) (word, int, bool) {
+	for i := 1; i+1 < len(parts); i++ {
+		if isPlainText(parts[i], "]") && parts[i+1].tType == ASSIGN {
+			return word{parts: parts[1:i]}, i + 2, true
+		}
+	}
+	return word{}, 0, false
+}
+
+func isPlainText(t Token, text string) bool {
+	return t.tType == IDENT && !t.quoted && t.literal == text
+}
+
+// startsArray reports whether an assignment with nothing after its = is
+// followed by the ( ... ) of an array.
+func (p *parser) startsArray(a assignmentNode) bool {
+	return a.subscript == nil && len(a.value.parts) == 0 && p.current().tType == LPAREN
+}
+
+// parseArrayElements parses the ( ... ) of an array assignment, which may
+// span lines. It returns the elements and the offset in the input just
+// past the closing parenthesis.
+func (p *parser) parseArrayElements() ([]arrayElement, int, error) {
+	p.advance()
+	elements := []arrayElement{}
+	for {
+		p.skipBlank()
+		t := p.current()
+		switch {
+		case t.tType == RPAREN:
+			p.advance()
+			return elements, t.position + 1, nil
+		case t.tType == EOF:
+			return nil, 0, p.unexpectedEnd()
+		case !isWordToken(t.tType):
+			return nil, 0, p.unexpected()
+		}
+
+		w := p.parseWord()
+		element := arrayElement{value: w}
+		if isPlainText(w.parts[0], "[") {
+			if key, next, ok := splitSubscript(w.parts); ok {
+				element = arrayElement{key: &key, value: word{parts: w.parts[next:]}}
 			}
-			result = append(result, t.literal)
-			previousType = t.tType
-		default:
-			result = append(result, t.literal)
-			previousType = t.tType
 		}
+		elements = append(elements, element)
 	}
+}
+
+// parseArrayText parses text of the form ( ... ) as the elements of an
+// array assignment, for builtins like declare that take one as argument.
+func parseArrayText(text string) ([]arrayElement, error) {
+	p, err := newParser(text, nil)
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.current().tType != LPAREN {
+		return nil, p.unexpected()
+	}
+	elements, _, err := p.parseArrayElements()
+	if err != nil {
+		return nil, err
+	}
+	p.skipBlank()
+	if p.current().tType != EOF {
+		return nil, p.unexpected()
+	}
+	return elements, nil
+}
 
-	return commandReceived{
-		command: commandLiteral,
-		params: result,
+// isDeclaration reports whether a command is one of the builtins whose
+// NAME=( ... ) arguments are array assignments.
+func isDeclaration(c *simpleCommand) bool {
+	if len(c.words) == 0 || len(c.words[0].parts) != 1 || c.words[0].parts[0].quoted {
+		return false
+	}
+	switch c.words[0].parts[0].literal {
+	case "declare", "typeset", "local":
+		return true
 	}
+	return false
+}
 
-}
\ No newline at end of file
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// needsMoreInput reports whether the text typed so far is an unfinished
+// command that continuation lines could still complete.
+func needsMoreInput(text string) bool {
+	_, err := parseInput(text, nil)
+	var syntaxErr *syntaxError
+	return errors.As(err, &syntaxErr) && syntaxErr.incomplete
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// matchPattern reports whether s matches a shell pattern as a whole. *
+// matches any string, ? any single character and [...] one character of a
+// set, negated by a leading ! or ^, which may include ranges like a-z and
+// classes like [:digit:]. A backslash makes the next character match itself.
+func matchPattern(pattern string, s string) bool {
+	// The position after the last * seen and the text it had matched, to
+	// backtrack to when the rest of the pattern fails.
+	starPattern, starText := -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				p++
+				starPattern, starText = p, i
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if matched, next, ok := matchBracket(pattern, p, s[i]); ok {
+					if matched {
+						p = next
+						i++
+						continue
+					}
+					break
+				}
+				if s[i] == '[' {
+					p++
+					i++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == s[i] {
+					p += 2
+					i++
+					continue
+				}
+			default:
+				if pattern[p] == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+		if starPattern < 0 {
+			return false
+		}
+		starText++
+		p, i = starPattern, starText
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchBracket matches c against the bracket expression starting at
+// pattern[start]. It returns whether c is in the set and the position after
+// the expression, with ok false when the [ is not closed and so stands for
+// itself.
+func matchBracket(pattern string, start int, c byte) (matched bool, next int, ok bool) {
+	i := start + 1
+	negate := false
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		negate = true
+		i++
+	}
+	first := true
+	for i < len(pattern) && (first || pattern[i] != ']') {
+		first = false
+		if strings.HasPrefix(pattern[i:], "[:") {
+			if end := strings.Index(pattern[i+2:], ":]"); end >= 0 {
+				if inClass(pattern[i+2:i+2+end], c) {
+					matched = true
+				}
+				i += end + 4
+				continue
+			}
+		}
+		lo := pattern[i]
+		if lo == '\\' && i+1 < len(pattern) {
+			i++
+			lo = pattern[i]
+		}
+		hi := lo
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			if hi == '\\' && i+3 < len(pattern) {
+				i++
+				hi = pattern[i+2]
+			}
+			i += 2
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+		i++
+	}
+	if i >= len(pattern) {
+		return false, 0, false
+	}
+	return matched != negate, i + 1, true
+}
+
+// inClass reports whether c belongs to the POSIX character class name.
+func inClass(name string, c byte) bool {
+	r := rune(c)
+	switch name {
+	case "alpha":
+		return unicode.IsLetter(r)
+	case "digit":
+		return '0' <= c && c <= '9'
+	case "alnum":
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	case "upper":
+		return unicode.IsUpper(r)
+	case "lower":
+		return unicode.IsLower(r)
+	case "space":
+		return unicode.IsSpace(r)
+	case "blank":
+		return c == ' ' || c == '\t'
+	case "punct":
+		return c > 0x20 && c < 0x7f && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	case "xdigit":
+		return strings.IndexByte("0123456789abcdefABCDEF", c) >= 0
+	case "cntrl":
+		return unicode.IsControl(r)
+	case "print":
+		return c >= 0x20 && c < 0x7f
+	case "graph":
+		return c > 0x20 && c < 0x7f
+	}
+	return false
+}
@@ -1,136 +1,493 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
-
-	"golang.org/x/term"
+	"strings"
+	"syscall"
 )
 
 type pipelineCommand interface {
-	start(termState *term.State) error
-	wait() error
-	setStdin(io.Reader)
-	setStdout(io.Writer)
-	setStderr(io.Writer)
-	readsStdin() bool
-	ownsStdout() bool
+	// start runs the command. attr holds the process group settings of
+	// external commands and is nil without job control.
+	start(attr *syscall.SysProcAttr) error
+	// pid is the process id of an external command, 0 for builtins.
+	pid() int
+	// watch blocks until the command is done, reporting every change of
+	// state on the way there.
+	watch(report func(state processState, status int, sig syscall.Signal))
+	setFiles(fds fdTable)
+	// handOver gives the command files it must close once they are no
+	// longer needed: right after starting a child process, or when a
+	// builtin running inside the shell returns.
+	handOver(files []*os.File)
 }
 
+// externalCmd is a program to run. exec.Cmd resolves its path, but the
+// process is started with os.StartProcess, as exec.Cmd would replace a
+// closed standard descriptor with /dev/null.
 type externalCmd struct {
-	cmd    *exec.Cmd
-	rStdin bool
+	cmd *exec.Cmd
+	// files are the descriptors of the process, from 0 up. A nil entry is
+	// closed in the process.
+	files []*os.File
+	owned []*os.File
+}
+
+func (e *externalCmd) setFiles(fds fdTable) {
+	e.files = append([]*os.File{fds[0], fds[1], fds[2]}, extraFiles(fds)...)
+}
+
+func (e *externalCmd) handOver(files []*os.File) { e.owned = files }
+
+func (e *externalCmd) start(attr *syscall.SysProcAttr) error {
+	defer closeAll(e.owned)
+	if e.cmd.Err != nil {
+		return e.cmd.Err
+	}
+	p, err := os.StartProcess(e.cmd.Path, e.cmd.Args, &os.ProcAttr{Env: e.cmd.Env, Files: e.files, Sys: attr})
+	if err != nil {
+		return err
+	}
+	e.cmd.Process = p
+	return nil
+}
+
+// run starts the command and waits for it to finish, for builtins that run
+// one of their own.
+func (e *externalCmd) run() error {
+	if err := e.start(nil); err != nil {
+		return err
+	}
+	state, err := e.cmd.Process.Wait()
+	if err != nil {
+		return err
+	}
+	if !state.Success() {
+		return &exec.ExitError{ProcessState: state}
+	}
+	return nil
 }
 
-func (e *externalCmd) setStdin(r io.Reader)  { e.cmd.Stdin = r }
-func (e *externalCmd) setStdout(w io.Writer) { e.cmd.Stdout = w }
-func (e *externalCmd) setStderr(w io.Writer) { e.cmd.Stderr = w }
+func (e *externalCmd) pid() int { return e.cmd.Process.Pid }
 
-func (e *externalCmd) start(_ *term.State) error { return e.cmd.Start() }
-func (e *externalCmd) wait() error               { return e.cmd.Wait() }
-func (e *externalCmd) readsStdin() bool          { return e.rStdin }
-func (e *externalCmd) ownsStdout() bool          { return false }
+// watch waits for the process with wait4 rather than exec.Cmd.Wait, which
+// cannot tell that a process stopped or continued.
+func (e *externalCmd) watch(report func(state processState, status int, sig syscall.Signal)) {
+	for {
+		var ws syscall.WaitStatus
+		_, err := syscall.Wait4(e.cmd.Process.Pid, &ws, syscall.WUNTRACED|syscall.WCONTINUED, nil)
+		switch {
+		case err == syscall.EINTR:
+			continue
+		case err != nil:
+			report(processDone, 1, 0)
+		case ws.Stopped():
+			report(processStopped, 128+int(ws.StopSignal()), 0)
+			continue
+		case ws.Continued():
+			report(processRunning, 0, 0)
+			continue
+		case ws.Signaled():
+			report(processDone, 128+int(ws.Signal()), ws.Signal())
+		default:
+			report(processDone, ws.ExitStatus(), 0)
+		}
+		e.cmd.Process.Release()
+		return
+	}
+}
 
-func newExternalCmd(name string, args []string) *externalCmd {
+func newExternalCmd(name string, args []string, env []string) *externalCmd {
+	cmd := exec.Command(name, args...)
+	cmd.Env = env
 	return &externalCmd{
-		cmd:    exec.Command(name, args...),
-		rStdin: true,
+		cmd: cmd,
 	}
 }
 
 type builtinCmd struct {
-	fn     builtin
-	args   []string
-	in     io.Reader
-	out    io.Writer
-	errOut io.Writer
-	done   chan error
-	rStdin bool
-	history []string
+	name        string
+	fn          builtin
+	args        []string
+	in          io.Reader
+	out         io.Writer
+	errOut      io.Writer
+	done        chan error
+	menu        *builtInMenu
+	assignments []assignment
+	owned       []*os.File
+}
+
+// closedFile stands in for a descriptor a builtin was started without.
+// Using it fails with EBADF, and it remembers whether the builtin tried to
+// write, as most builtins do not check for write errors themselves.
+type closedFile struct {
+	written bool
+}
+
+func (c *closedFile) Read([]byte) (int, error) { return 0, syscall.EBADF }
+
+func (c *closedFile) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c.written = true
+	return 0, syscall.EBADF
+}
+
+// diagnosticWriter is the standard error of a builtin run from a script. It
+// starts every line with the shell's diagnostic prefix, so that the errors
+// of builtins say where they happened like those of the shell.
+type diagnosticWriter struct {
+	f       *os.File
+	prefix  string
+	midLine bool
+}
+
+func (d *diagnosticWriter) Write(p []byte) (int, error) {
+	var b bytes.Buffer
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if !d.midLine {
+			b.WriteString(d.prefix)
+		}
+		b.Write(line)
+		d.midLine = line[len(line)-1] != '\n'
+	}
+	if _, err := d.f.Write(b.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (b *builtinCmd) setFiles(fds fdTable) {
+	b.in = &closedFile{}
+	b.out = &closedFile{}
+	b.errOut = &closedFile{}
+	if f := fds[0]; f != nil {
+		b.in = f
+	}
+	if f := fds[1]; f != nil {
+		b.out = f
+	}
+	if f := fds[2]; f != nil {
+		b.errOut = b.menu.diagnostics(f)
+	}
 }
 
-func (b *builtinCmd) setStdin(r io.Reader)  { b.in = r }
-func (b *builtinCmd) setStdout(w io.Writer) { b.out = w }
-func (b *builtinCmd) setStderr(w io.Writer) { b.errOut = w }
+func (b *builtinCmd) handOver(files []*os.File) { b.owned = files }
 
-func (b *builtinCmd) start(termState *term.State) error {
+func (b *builtinCmd) start(_ *syscall.SysProcAttr) error {
 	go func() {
-		err := b.fn(b.in, b.out, b.args, termState, &b.history)
-		if c, ok := b.out.(io.Closer); ok && c != os.Stdout && c != os.Stderr {
-			c.Close()
+		restoreVars, err := b.menu.vars.applyTemporary(b.assignments)
+		if err == nil {
+			err = b.fn(b.in, b.out, b.errOut, b.args, b.menu)
+		}
+		if c, ok := b.out.(*closedFile); ok && c.written && err == nil {
+			err = fmt.Errorf("write error: %s", capitalize(syscall.EBADF.Error()))
+		}
+		restoreVars()
+		if err != nil && !isExitStatus(err) {
+			fmt.Fprintf(b.errOut, "%s: %s\n", b.name, err)
 		}
+		closeAll(b.owned)
 		b.done <- err
 	}()
 	return nil
 }
 
-func (b *builtinCmd) wait() error {
-	return <-b.done
+func (b *builtinCmd) pid() int { return 0 }
+
+func (b *builtinCmd) watch(report func(state processState, status int, sig syscall.Signal)) {
+	report(processDone, statusFromError(<-b.done), 0)
 }
-func (b *builtinCmd) readsStdin() bool { return b.rStdin }
-func (b *builtinCmd) ownsStdout() bool { return true }
 
-func newBuiltinCmd(fn builtin, args []string, history []string) *builtinCmd {
+func newBuiltinCmd(name string, fn builtin, args []string, menu *builtInMenu, assignments []assignment) *builtinCmd {
 	return &builtinCmd{
-		fn:   fn,
-		args: args,
-		done: make(chan error, 1),
-		history: history,
+		name:        name,
+		fn:          fn,
+		args:        args,
+		done:        make(chan error, 1),
+		menu:        menu,
+		assignments: assignments,
 	}
 }
 
-func processPipeline(commands []commandReceived, menu *builtInMenu, termOldState *term.State) error {
-	pipelineCommands := make([]pipelineCommand, len(commands))
+// newSubshellCmd prepares a ( ... ) group to run in a new instance of the
+// shell, so nothing it changes affects this one.
+func newSubshellCmd(s *subshell, menu *builtInMenu) (*externalCmd, error) {
+	return newShellCmd(s.source, menu)
+}
+
+// newShellCmd prepares source to run in a new instance of the shell. The
+// shell's functions, variables and special parameters are passed along
+// in its environment and recreated before it runs.
+func newShellCmd(source string, menu *builtInMenu) (*externalCmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	args := append([]string{"-c", source, menu.vars.shellName}, menu.vars.positional...)
+	environment := append(menu.vars.environ(), menu.subshellState())
+	return newExternalCmd(self, args, environment), nil
+}
 
-	for i, c := range commands {
-		isBuiltIn := menu.isBuiltIn(c.command)
-		if isBuiltIn {
-			cmd := menu.commands[c.command]
-			pipelineCommands[i] = newBuiltinCmd(cmd, c.params, menu.history)
+// commandText is a command that runs argv with assignments, quoted so that
+// a subshell does not expand any of it again.
+func commandText(assignments []assignment, argv []string) string {
+	parts := []string{}
+	for _, a := range assignments {
+		parts = append(parts, a.name+"="+singleQuote(a.value))
+	}
+	for _, arg := range argv {
+		parts = append(parts, singleQuote(arg))
+	}
+	return strings.Join(parts, " ")
+}
+
+// stageMode says how much a stage of a pipeline may share with the shell.
+type stageMode int
+
+const (
+	// stageInShell is the only command of a foreground pipeline. It runs
+	// inside the shell and can change its state.
+	stageInShell stageMode = iota
+	// stageAlongside is a command of a foreground pipeline of several.
+	// Builtins that only report on the shell's state still run inside it,
+	// as it does nothing but wait meanwhile.
+	stageAlongside
+	// stageInBackground is a command of a background job.
+	stageInBackground
+)
+
+// pipelineStage is a command of a pipeline that is ready to start, together
+// with the descriptors it was wired to. command is nil when there is nothing
+// to run, either because the command was empty or because preparing it
+// failed with status.
+type pipelineStage struct {
+	command pipelineCommand
+	name    string
+	fds     fdTable
+	owned   []*os.File
+	status  int
+}
+
+// prepareStage expands a command and applies its redirections on top of the
+// descriptors given by its position in the pipeline. Functions are looked up
+// before builtins and PATH, and a function definition is recorded on the
+// spot. Unless the stage runs in the shell, functions, compound commands and
+// builtins run in a subshell started from source, so that whatever they
+// change stays out of the shell, as in bash.
+func prepareStage(node commandNode, source string, base fdTable, menu *builtInMenu, mode stageMode) *pipelineStage {
+	stage := &pipelineStage{fds: base}
+	// An error that stops the shell only fails a stage that runs outside
+	// of it, which bash would have run in a subshell.
+	fail := func(err error) *pipelineStage {
+		if mode == stageInShell {
+			reportExpansionError(base[2], err, menu)
 		} else {
-			paramsWithoutSpaces := filterSpacesFromParams(c.params)
-			pipelineCommands[i] = newExternalCmd(c.command, paramsWithoutSpaces)
+			printExpansionError(base[2], err, menu)
+		}
+		stage.status = 1
+		return stage
+	}
+	var c *simpleCommand
+	switch n := node.(type) {
+	case *functionDefinition:
+		if mode == stageInShell {
+			n.defined = menu.location
+			menu.functions[n.name] = n
 		}
+		return stage
+	case *subshell:
+		fds, opened, err := applyRedirections(n.redirections, base, menu)
+		if err != nil {
+			return fail(err)
+		}
+		stage.fds = fds
+		stage.owned = opened
+		stage.name = "("
+		stage.command, err = newSubshellCmd(n, menu)
+		if err != nil {
+			menu.errorf(base[2], "%s", err)
+			stage.status = 1
+		}
+		return stage
+	case compoundNode:
+		if mode == stageInShell {
+			stage.command = newBuiltinCmd("", compoundBuiltin(n), nil, menu, nil)
+			return stage
+		}
+		var err error
+		if stage.command, err = newShellCmd(source, menu); err != nil {
+			menu.errorf(base[2], "%s", err)
+			stage.status = 1
+		}
+		return stage
+	case *simpleCommand:
+		c = n
+	}
+	interrupts := menu.jobs.interruptCount()
+	argv, err := expandWords(c.words, menu)
+	if err != nil {
+		return fail(err)
+	}
+	assignments, err := expandAssignments(c.assignments, menu)
+	if err != nil {
+		return fail(err)
+	}
+	// A command substitution cut short by ^C abandons the whole command.
+	if menu.jobs.interruptCount() != interrupts {
+		stage.status = 128 + int(syscall.SIGINT)
+		return stage
 	}
 
-	pipes := make([][2]*os.File, len(pipelineCommands)-1)
+	fds, opened, err := applyRedirections(c.redirections, base, menu)
+	if err != nil {
+		return fail(err)
+	}
+	stage.fds = fds
+	stage.owned = opened
+	if len(argv) == 0 {
+		return stage
+	}
 
-	for i := 0; i < len(pipes); i++ {
-		r, w, err := os.Pipe()
-		if err != nil {
-			return err
+	stage.name = argv[0]
+	f, isFunction := menu.functions[argv[0]]
+	fn, isBuiltin := menu.commands[argv[0]]
+	inShell := mode == stageInShell ||
+		(mode == stageAlongside && !isFunction && isCapturable(argv[0], len(argv)-1) && len(assignments) == 0)
+	switch {
+	case (isFunction || isBuiltin) && !inShell:
+		if stage.command, err = newShellCmd(commandText(assignments, argv), menu); err != nil {
+			menu.errorf(fds[2], "%s", err)
+			stage.status = 1
+		}
+		return stage
+	case isFunction:
+		stage.command = newBuiltinCmd(argv[0], functionBuiltin(f), argv[1:], menu, assignments)
+		return stage
+	case isBuiltin:
+		stage.command = newBuiltinCmd(argv[0], fn, argv[1:], menu, assignments)
+		return stage
+	}
+	path := argv[0]
+	if !strings.Contains(argv[0], "/") {
+		if path = lookupCommand(argv[0], assignments); path == "" {
+			menu.errorf(fds[2], "%s: command not found", argv[0])
+			stage.status = commandNotFoundStatus
+			return stage
 		}
-		pipes[i] = [2]*os.File{r, w}
 	}
+	external := newExternalCmd(path, argv[1:], menu.vars.environWith(assignments))
+	// The program still sees the name it was called by.
+	external.cmd.Args[0] = argv[0]
+	stage.command = external
+	return stage
+}
 
-	for i, pc := range pipelineCommands {
-		if i == 0 {
-			pc.setStdin(os.Stdin)
-		} else {
-			pc.setStdin(pipes[i-1][0])
+// lookupCommand finds the program a command name runs. A PATH among the
+// assignments of the command is searched instead of the shell's, as in
+// "PATH=/opt/bin cmd".
+func lookupCommand(name string, assignments []assignment) string {
+	for i := len(assignments) - 1; i >= 0; i-- {
+		if assignments[i].name == "PATH" {
+			return findCommandIn(name, strings.Split(assignments[i].value, ":"))
 		}
+	}
+	return getCommandDirectoryAsync(name)
+}
 
-		if i == len(pipelineCommands)-1 {
-			pc.setStdout(os.Stdout)
-		} else {
-			pc.setStdout(pipes[i][1])
+// processPipeline starts every stage of a pipeline concurrently as a job.
+// base supplies the stdin of the first stage, the stdout of the last one and
+// everyone's stderr. The job is registered in the job table unless it runs in
+// the foreground without any process of its own.
+func processPipeline(p *pipeline, menu *builtInMenu, base fdTable, foreground bool) (*job, error) {
+	j := &job{command: p.String(), background: !foreground}
+	mode := stageInShell
+	switch {
+	case !foreground:
+		mode = stageInBackground
+	case len(p.commands) > 1:
+		mode = stageAlongside
+	}
+	stages := make([]*pipelineStage, len(p.commands))
+	var previousRead *os.File
+
+	for i, node := range p.commands {
+		stageBase := base.clone()
+		pipeEnds := []*os.File{}
+		if previousRead != nil {
+			stageBase[0] = previousRead
+			pipeEnds = append(pipeEnds, previousRead)
+			previousRead = nil
+		}
+		if i < len(p.commands)-1 {
+			r, w, err := os.Pipe()
+			if err != nil {
+				return nil, err
+			}
+			stageBase[1] = w
+			pipeEnds = append(pipeEnds, w)
+			previousRead = r
 		}
 
-		pc.setStderr(os.Stderr)
+		stage := prepareStage(node, p.sources[i], stageBase, menu, mode)
+		stages[i] = stage
+		proc := &process{state: processDone, status: stage.status}
+		j.processes = append(j.processes, proc)
+		if stage.command == nil {
+			closeAll(append(pipeEnds, stage.owned...))
+			continue
+		}
+
+		stage.command.setFiles(stage.fds)
+		stage.command.handOver(append(pipeEnds, stage.owned...))
+		if err := stage.command.start(menu.jobs.procAttr(j.pgid, foreground)); err != nil {
+			menu.errorf(stage.fds[2], "%s", describeStartError(stage.name, err))
+			proc.status = startErrorStatus(err)
+			continue
+		}
+		proc.state = processRunning
+		proc.pid = stage.command.pid()
+		if j.pgid == 0 && proc.pid != 0 && menu.jobs.interactive {
+			j.pgid = proc.pid
+		}
+	}
 
-		if err := pc.start(termOldState); err != nil {
-			return err
+	if j.pgid != 0 || !foreground {
+		menu.jobs.add(j)
+	}
+	// Nothing is reaped before every stage started, so the group leader
+	// stays around for the later stages to join its process group.
+	for i, stage := range stages {
+		if j.processes[i].state == processRunning {
+			go menu.jobs.watch(j.processes[i], stage.command)
 		}
 	}
+	return j, nil
+}
 
-	for _, p := range pipes {
-		p[0].Close()
-		p[1].Close()
+func describeStartError(name string, err error) string {
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, exec.ErrNotFound) {
+		return fmt.Sprintf("%s: No such file or directory", name)
+	}
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Sprintf("%s: Permission denied", name)
 	}
+	return fmt.Sprintf("%s: %s", name, err)
+}
 
-	for _, pc := range pipelineCommands {
-		pc.wait()
+func startErrorStatus(err error) int {
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, exec.ErrNotFound) {
+		return commandNotFoundStatus
 	}
-	return nil
+	return 126
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// fdTable maps the file descriptors a command will see to the open files
+// behind them. A missing entry is a closed descriptor.
+type fdTable map[int]*os.File
+
+func newFdTable(stdin *os.File, stdout *os.File, stderr *os.File) fdTable {
+	return fdTable{0: stdin, 1: stdout, 2: stderr}
+}
+
+// standardFds is the table of the shell's own standard descriptors.
+func standardFds() fdTable {
+	return newFdTable(os.Stdin, os.Stdout, os.Stderr)
+}
+
+// fdTableOf recovers the descriptors a builtin was started with from the
+// streams it was handed. Descriptors that were closed are left out.
+func fdTableOf(in io.Reader, out io.Writer, errOut io.Writer) fdTable {
+	fds := fdTable{}
+	if f, ok := in.(*os.File); ok {
+		fds[0] = f
+	}
+	if f, ok := out.(*os.File); ok {
+		fds[1] = f
+	}
+	switch w := errOut.(type) {
+	case *os.File:
+		fds[2] = w
+	case *diagnosticWriter:
+		fds[2] = w.f
+	}
+	return fds
+}
+
+func (t fdTable) clone() fdTable {
+	copied := fdTable{}
+	for fd, f := range t {
+		copied[fd] = f
+	}
+	return copied
+}
+
+// applyRedirections performs the redirections of a command from left to
+// right on top of base, the way POSIX specifies, so "> log 2>&1" and
+// "2>&1 > log" differ. It returns the resulting table and the files it
+// opened, which the caller closes once the command is done with them.
+func applyRedirections(redirections []redirection, base fdTable, menu *builtInMenu) (fdTable, []*os.File, error) {
+	fds := base.clone()
+	opened := []*os.File{}
+	fail := func(err error) (fdTable, []*os.File, error) {
+		closeAll(opened)
+		return nil, nil, err
+	}
+
+	for _, r := range redirections {
+		target, err := redirectionTarget(r, menu)
+		if err != nil {
+			return fail(err)
+		}
+		fd := r.fd
+		if fd < 0 {
+			fd = defaultFd(r.op)
+		}
+
+		switch r.op {
+		case ">&", "<&":
+			if target == "-" {
+				delete(fds, fd)
+				continue
+			}
+			source, err := strconv.Atoi(target)
+			if err != nil {
+				if r.op == "<&" || r.fd >= 0 {
+					return fail(fmt.Errorf("%s: ambiguous redirect", target))
+				}
+				// ">&file" without a descriptor is the old spelling of "&>file".
+				f, err := openRedirectionTarget("&>", target)
+				if err != nil {
+					return fail(err)
+				}
+				opened = append(opened, f)
+				fds[1] = f
+				fds[2] = f
+				continue
+			}
+			f, ok := fds[source]
+			if !ok {
+				return fail(fmt.Errorf("%d: Bad file descriptor", source))
+			}
+			fds[fd] = f
+		case "&>", "&>>":
+			f, err := openRedirectionTarget(r.op, target)
+			if err != nil {
+				return fail(err)
+			}
+			opened = append(opened, f)
+			fds[1] = f
+			fds[2] = f
+		default:
+			f, err := openRedirectionTarget(r.op, target)
+			if err != nil {
+				return fail(err)
+			}
+			opened = append(opened, f)
+			fds[fd] = f
+		}
+	}
+	return fds, opened, nil
+}
+
+// redirectionTarget expands the word after a redirection operator. The body
+// of a here-document or here-string is a single string no matter what it
+// expands to; a file name is split and globbed like an argument and has to
+// come out as exactly one word.
+func redirectionTarget(r redirection, menu *builtInMenu) (string, error) {
+	if isHeredoc(r.op) || r.op == "<<<" {
+		return expandWord(r.target, menu)
+	}
+	fields, err := expandWords([]word{r.target}, menu)
+	var noMatch *noMatchError
+	if errors.As(err, &noMatch) {
+		// Unlike in the arguments, it only fails the command.
+		return "", errors.New(err.Error())
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(fields) != 1 {
+		return "", fmt.Errorf("%s: ambiguous redirect", r.target)
+	}
+	return fields[0], nil
+}
+
+func isHeredoc(op string) bool {
+	return op == "<<" || op == "<<-"
+}
+
+func defaultFd(op string) int {
+	switch op {
+	case "<", "<>", "<<", "<<-", "<<<", "<&":
+		return 0
+	}
+	return 1
+}
+
+func openRedirectionTarget(op string, target string) (*os.File, error) {
+	switch op {
+	case ">", ">|", "&>":
+		return os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	case ">>", "&>>":
+		return os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	case "<":
+		return os.Open(target)
+	case "<>":
+		return os.OpenFile(target, os.O_RDWR|os.O_CREATE, 0644)
+	case "<<<":
+		return stringReader(target + "\n")
+	case "<<", "<<-":
+		return stringReader(target)
+	}
+	return nil, fmt.Errorf("%s: unsupported redirection", op)
+}
+
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
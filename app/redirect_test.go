@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRedirectionTarget checks that a file name after a redirection is split
+// and globbed like an argument and has to name exactly one file.
+func TestRedirectionTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   []string
+		vars    map[string]string
+		line    string
+		want    string
+		wantErr string
+	}{
+		{name: "plain name", line: "echo > out", want: "out"},
+		{name: "quoted blanks", line: `echo > "a b"`, want: "a b"},
+		{name: "one match", files: []string{"log.txt"}, line: "echo > *.txt", want: "log.txt"},
+		{name: "no match", line: "echo > *.txt", want: "*.txt"},
+		{name: "pattern in a variable", files: []string{"log.txt"}, vars: map[string]string{"x": "*.txt"}, line: "echo > $x", want: "log.txt"},
+		{name: "quoted pattern", files: []string{"log.txt"}, line: `echo > "*.txt"`, want: "*.txt"},
+		{name: "split into two", vars: map[string]string{"x": "a b"}, line: "echo > $x", wantErr: "$x: ambiguous redirect"},
+		{name: "two matches", files: []string{"a.txt", "b.txt"}, line: "echo > *.txt", wantErr: "*.txt: ambiguous redirect"},
+		{name: "empty expansion", vars: map[string]string{"e": ""}, line: "echo > $e", wantErr: "$e: ambiguous redirect"},
+		{name: "here-string is not split", vars: map[string]string{"x": "a  b"}, line: "cat <<< $x", want: "a  b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Chdir(dir)
+
+			menu := newBuiltInMenu(false)
+			menu.vars.syncEnv = false
+			for name, value := range tt.vars {
+				menu.vars.set(name, value)
+			}
+
+			list, err := parseInput(tt.line, nil)
+			if err != nil {
+				t.Fatalf("parseInput(%q): %v", tt.line, err)
+			}
+			c := list.entries[0].pipeline.commands[0].(*simpleCommand)
+			got, err := redirectionTarget(c.redirections[0], menu)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("redirectionTarget(%q) error = %v, want %q", tt.line, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("redirectionTarget(%q): %v", tt.line, err)
+			}
+			if got != tt.want {
+				t.Errorf("redirectionTarget(%q) = %q, want %q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
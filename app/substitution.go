@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+)
+
+// capturableBuiltins are the builtins a command substitution runs inside
+// the shell instead of a subshell. They only report on the shell's state,
+// so running them in place cannot change it.
+var capturableBuiltins = map[string]bool{
+	"echo": true,
+	"jobs": true,
+	"pwd":  true,
+	"type": true,
+}
+
+// isCapturable reports whether calling the builtin name with args arguments
+// only reports on the shell's state. history does without arguments, but
+// history -r file, for one, loads lines into the shell's history.
+func isCapturable(name string, args int) bool {
+	if name == "history" {
+		return args == 0
+	}
+	return capturableBuiltins[name]
+}
+
+// commandSubstitution runs the command of a $(...) or `...` substitution and
+// returns what it wrote to its standard output, without trailing newlines.
+// $? is left at the status of the command.
+func commandSubstitution(source string, menu *builtInMenu) string {
+	var out bytes.Buffer
+	if c, ok := capturableCommand(source, menu); ok {
+		menu.vars.lastStatus = captureBuiltin(c, menu, &out)
+	} else {
+		menu.vars.lastStatus = captureSubshell(source, menu, &out)
+	}
+	return strings.TrimRight(out.String(), "\n")
+}
+
+// capturableCommand parses source and returns it when it is a lone call of
+// one of the capturable builtins, with neither redirections nor assignments.
+func capturableCommand(source string, menu *builtInMenu) (*simpleCommand, bool) {
+	list, err := parseInput(source, nil)
+	if err != nil || len(list.entries) != 1 || list.entries[0].background {
+		return nil, false
+	}
+	p := list.entries[0].pipeline
+	c, ok := p.commands[0].(*simpleCommand)
+	if !ok || len(p.commands) != 1 || len(c.words) == 0 || len(c.assignments) > 0 || len(c.redirections) > 0 {
+		return nil, false
+	}
+	name := c.words[0].parts
+	if len(name) != 1 || name[0].tType != IDENT || name[0].quoted {
+		return nil, false
+	}
+	if _, ok := menu.functions[name[0].literal]; ok {
+		return nil, false
+	}
+	return c, isCapturable(name[0].literal, len(c.words)-1)
+}
+
+func captureBuiltin(c *simpleCommand, menu *builtInMenu, out io.Writer) int {
+	argv, err := expandWords(c.words, menu)
+	if err != nil {
+		printExpansionError(os.Stderr, err, menu)
+		return 1
+	}
+	err = menu.commands[argv[0]](strings.NewReader(""), out, menu.diagnostics(os.Stderr), argv[1:], menu)
+	if err != nil && !isExitStatus(err) {
+		menu.errorf(os.Stderr, "%s: %s", argv[0], err)
+	}
+	return statusFromError(err)
+}
+
+// captureSubshell runs source in a subshell with its standard output going
+// to out. The subshell shares the shell's process group, so ^C reaches it
+// just like the shell.
+func captureSubshell(source string, menu *builtInMenu, out io.Writer) int {
+	r, w, err := os.Pipe()
+	if err != nil {
+		menu.errorf(os.Stderr, "%s", err)
+		return 1
+	}
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(out, r)
+		r.Close()
+		close(copied)
+	}()
+
+	fds := standardFds()
+	fds[1] = w
+	p := pipelineOf(&subshell{source: source}, "("+source+")")
+	status := runPipeline(p, menu.detached(), fds)
+	w.Close()
+	<-copied
+	return status
+}
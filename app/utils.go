@@ -2,16 +2,14 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"os/exec"
 	"strings"
 	"sync"
-
-	"golang.org/x/term"
+	"syscall"
 )
 
 func getPathDirectories() []string {
@@ -80,8 +78,12 @@ func getCommandDirectory(c string) string {
 
 // Async implementation
 func getCommandDirectoryAsync(c string) string {
+	return findCommandIn(c, getPathDirectories())
+}
+
+// findCommandIn looks for an executable called c in directories.
+func findCommandIn(c string, directories []string) string {
 	result := make(chan string)
-	directories := getPathDirectories()
 
 	var once sync.Once
 	var wg sync.WaitGroup
@@ -117,74 +119,48 @@ func getCommandDirectoryAsync(c string) string {
 	return ""
 }
 
-func filterSpacesFromParams(params []string) []string {
-	filtered := []string{}
-	var currentArg string
-	for _, p := range params {
-		if p == " " {
-			filtered = append(filtered, currentArg)
-			currentArg = ""
-			continue
-		}
-		currentArg += p
-	}
-	if currentArg != "" {
-		filtered = append(filtered, currentArg)
+// stringReader serves content through a pipe so it can be used anywhere a
+// real file descriptor is expected, such as the stdin of a child process.
+func stringReader(content string) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
 	}
-	return filtered
+	go func() {
+		io.WriteString(w, content)
+		w.Close()
+	}()
+	return r, nil
 }
 
-type redirectionType string
-
-const (
-	successOut redirectionType = "successOut"
-	errorOut   redirectionType = "errorOut"
-)
-
-type actionType string
-
-const (
-	redirectFile actionType = "redirect"
-	appendFile   actionType = "append"
-)
-
-func hasOutputRedirection(params []string) ([]string, []string, actionType, redirectionType, error) {
-	var commandParams []string
-	var destination []string
+func describeOpenError(err error) string {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		message := pathErr.Err.Error()
+		if errors.Is(err, os.ErrNotExist) {
+			message = "No such file or directory"
+		} else if errors.Is(err, os.ErrPermission) {
+			message = "Permission denied"
+		}
+		return fmt.Sprintf("%s: %s", pathErr.Path, message)
+	}
+	return err.Error()
+}
 
-	for i, p := range params {
-		if p == ">" || p == "1>" || p == "2>" {
-			if i+1 >= len(params) {
-				return nil, nil, "", "", errors.New("invalid destination")
-			}
-			commandParams = params[:i]
-			destination = params[i+1:]
-			var redirType redirectionType
-			switch p {
-			case "2>":
-				redirType = errorOut
-			default:
-				redirType = successOut
-			}
-			return commandParams, destination, redirectFile, redirType, nil
+// extraFiles lays out the descriptors above 2 the way exec.Cmd.ExtraFiles
+// expects them, where index i becomes fd 3+i in the child.
+func extraFiles(fds fdTable) []*os.File {
+	extra := []*os.File{}
+	for fd, f := range fds {
+		if fd < 3 || f == nil {
+			continue
 		}
-		if p == ">>" || p == "1>>" || p == "2>>" {
-			if i+1 >= len(params) {
-				return nil, nil, "", "", errors.New("invalid destination")
-			}
-			commandParams = params[:i]
-			destination = params[i+1:]
-			var redirType redirectionType
-			switch p {
-			case "2>>":
-				redirType = errorOut
-			default:
-				redirType = successOut
-			}
-			return commandParams, destination, appendFile, redirType, nil
+		for len(extra) < fd-2 {
+			extra = append(extra, nil)
 		}
+		extra[fd-3] = f
 	}
-	return params, nil, "", "", nil
+	return extra
 }
 
 func writeContentTofile(content []byte, destination string) error {
@@ -222,121 +198,6 @@ func readContentFromFile(out io.Writer, path string) error {
 	return scanner.Err()
 }
 
-func checkRedirection(output bytes.Buffer, destinationSlice []string, actionT actionType, redirectionT redirectionType, termOldState *term.State) (bool, error) {
-	if output.Len() > 0 {
-		if actionT == redirectFile && redirectionT == successOut {
-			destination := strings.Trim(strings.Join(destinationSlice, ""), " ")
-			err := writeContentTofile([]byte(output.Bytes()), destination)
-			if err != nil {
-				term.Restore(int(os.Stdin.Fd()), termOldState)
-				return false, err
-			}
-			return false, nil
-		}
-		if actionT == redirectFile && redirectionT == errorOut {
-			destination := strings.Trim(strings.Join(destinationSlice, ""), " ")
-			err := writeContentTofile([]byte(""), destination)
-			if err != nil {
-				term.Restore(int(os.Stdin.Fd()), termOldState)
-				return false, err
-			}
-			return true, nil
-		}
-
-		if actionT == appendFile && redirectionT == successOut {
-			destination := strings.Trim(strings.Join(destinationSlice, ""), " ")
-			err := appendContentToFile(output.String(), destination)
-			if err != nil {
-				term.Restore(int(os.Stdin.Fd()), termOldState)
-				return false, err
-			}
-			return false, nil
-		}
-
-		if actionT == appendFile && redirectionT == errorOut {
-			destination := strings.Trim(strings.Join(destinationSlice, ""), " ")
-			err := appendContentToFile("", destination)
-			if err != nil {
-				term.Restore(int(os.Stdin.Fd()), termOldState)
-				return false, err
-			}
-			return true, nil
-		}
-
-		return true, nil
-	}
-	return false, nil
-}
-
-func processExternalCommandOutput(
-	successString string,
-	successBytes []byte,
-	errorString string,
-	errorBytes []byte,
-	destinationSlice []string,
-	actionT actionType,
-	rT redirectionType,
-) {
-	if actionT == redirectFile && rT == successOut {
-		destination := destinationSlice[0]
-		err := writeContentTofile([]byte(transformNewLines(successString)), destination)
-		if err != nil {
-			log.Fatal(err)
-		}
-		if len(errorString) > 0 {
-			fmt.Printf("\r\n%s", removeNewLines(errorString))
-		}
-		return
-	}
-
-	if actionT == redirectFile && rT == errorOut {
-		destination := destinationSlice[0]
-		err := writeContentTofile([]byte(transformNewLines(errorString)), destination)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-
-	if actionT == appendFile && rT == successOut {
-		destination := destinationSlice[0]
-		err := appendContentToFile(successString, destination)
-		if err != nil {
-			log.Fatal(err)
-		}
-		if len(errorString) > 0 {
-			fmt.Printf("\r\n%s", removeNewLines(errorString))
-		}
-		return
-	}
-
-	if actionT == appendFile && rT == errorOut {
-		destination := destinationSlice[0]
-		err := appendContentToFile(errorString, destination)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-	if len(successString) > 0 {
-		fmt.Printf("\r\n%s", transformNewLines(successString))
-	}
-	if len(errorString) > 0 && actionT == "" && rT != errorOut {
-		fmt.Println("Executing error")
-		fmt.Printf("\r%s\r\n", errorString)
-	}
-
-}
-
-func removeNewLines(content string) string {
-	if len(content) > 0 && content[len(content)-1] == '\n' {
-		return content[:len(content)-1]
-	}
-	return content
-}
-
-func transformNewLines(content string) string {
-	return removeNewLines(strings.ReplaceAll(content, "\n", "\r\n"))
-}
-
 type historyRecord struct {
 	order int
 	value string
@@ -370,26 +231,49 @@ const (
 	appendMode historyMode = "-a"
 )
 
-func manageHistory(mode historyMode, termState *term.State, hList *[]string) error {
+func manageHistory(mode historyMode, hList *[]string) error {
 	historyPath := os.Getenv("HISTFILE")
 	if historyPath != "" {
 		switch mode {
 		case readMode:
-			err := history(os.Stdin, os.Stdout, []string{"-r", " ", historyPath}, termState, hList)
-			if err != nil {
-				return err
-			}
+			return readHistoryFile(historyPath, hList)
 		case writeMode:
-			err := history(os.Stdin, os.Stdout, []string{"-w", " ", historyPath}, termState, hList)
-			if err != nil {
-				return err
-			}
+			return writeHistoryFile(historyPath, *hList)
 		case appendMode:
-			err := history(os.Stdin, os.Stdout, []string{"-a", " ", historyPath}, termState, hList)
-			if err != nil {
-				return err
-			}
+			return appendHistoryFile(historyPath, *hList)
 		}
 	}
 	return nil
 }
+
+const commandNotFoundStatus = 127
+
+// statusFromError converts the result of running a command into the numeric
+// status exposed as $?, following the shell convention of 128+n for signals.
+func statusFromError(err error) int {
+	if err == nil {
+		return 0
+	}
+	var status exitStatus
+	if errors.As(err, &status) {
+		return int(status)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	return 1
+}
+
+func isExitStatus(err error) bool {
+	var status exitStatus
+	return errors.As(err, &status)
+}
+
+func isExitError(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr)
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type shellVariable struct {
+	value    string
+	exported bool
+	readonly bool
+	// unset marks a variable that was given attributes, as by export NAME,
+	// but no value yet. It expands like an unset variable and stays out of
+	// the environment.
+	unset bool
+	// indexed and assoc hold the elements of an indexed or an associative
+	// array. value is unused by arrays, where $name stands for the element
+	// with index or key 0.
+	indexed map[int]string
+	assoc   map[string]string
+}
+
+func (v *shellVariable) isArray() bool {
+	return v.indexed != nil || v.assoc != nil
+}
+
+// arrayEntry is an element of an array assignment such as arr=(a [5]=b).
+// key is only set for elements given with a [key]= subscript.
+type arrayEntry struct {
+	key   string
+	keyed bool
+	value string
+}
+
+// scope is what a function call shadows: the positional parameters of its
+// caller and the previous values of the variables it declared local, nil
+// for the ones that were unset.
+type scope struct {
+	positional []string
+	saved      map[string]*shellVariable
+}
+
+type variableStore struct {
+	values     map[string]*shellVariable
+	positional []string
+	// scopes has an entry for every function call in progress, the
+	// innermost last.
+	scopes     []*scope
+	lastStatus int
+	lastBgPid  int
+	// pid is $$, the process id of the top-level shell, which subshells
+	// inherit rather than report their own.
+	pid       int
+	shellName string
+	// syncEnv mirrors exported variables into the process environment so
+	// PATH lookups and HISTFILE follow the shell's own values.
+	syncEnv bool
+	// options holds the shopt options that change how words expand.
+	options map[string]bool
+}
+
+func newVariableStore() *variableStore {
+	vs := &variableStore{
+		values:    make(map[string]*shellVariable),
+		pid:       os.Getpid(),
+		shellName: os.Args[0],
+		syncEnv:   true,
+		options:   map[string]bool{},
+	}
+	for _, entry := range os.Environ() {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || !isValidName(name) {
+			continue
+		}
+		vs.values[name] = &shellVariable{value: value, exported: true}
+	}
+	return vs
+}
+
+// get resolves a parameter name, including the special parameters, to its value.
+func (vs *variableStore) get(name string) (string, bool) {
+	switch name {
+	case "?":
+		return strconv.Itoa(vs.lastStatus), true
+	case "$":
+		return strconv.Itoa(vs.pid), true
+	case "!":
+		if vs.lastBgPid == 0 {
+			return "", false
+		}
+		return strconv.Itoa(vs.lastBgPid), true
+	case "0":
+		return vs.shellName, true
+	case "#":
+		return strconv.Itoa(len(vs.positional)), true
+	case "@", "*":
+		return strings.Join(vs.positional, " "), true
+	}
+
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < 1 || n > len(vs.positional) {
+			return "", false
+		}
+		return vs.positional[n-1], true
+	}
+
+	v, ok := vs.values[name]
+	if !ok || v.unset {
+		return "", false
+	}
+	if v.isArray() {
+		return vs.element(name, "0")
+	}
+	return v.value, true
+}
+
+// set assigns a variable, or the element with index or key 0 of an array.
+func (vs *variableStore) set(name string, value string) error {
+	v, err := vs.writable(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case v.assoc != nil:
+		v.assoc["0"] = value
+	case v.indexed != nil:
+		v.indexed[0] = value
+	default:
+		v.value = value
+	}
+	vs.syncVariable(name)
+	return nil
+}
+
+// readonlyError is an attempt to change a readonly variable.
+type readonlyError struct {
+	name string
+}
+
+func (e *readonlyError) Error() string {
+	return e.name + ": readonly variable"
+}
+
+// writable returns the variable called name for a change, creating it when
+// it does not exist yet.
+func (vs *variableStore) writable(name string) (*shellVariable, error) {
+	v, ok := vs.values[name]
+	if ok && v.readonly {
+		return nil, &readonlyError{name: name}
+	}
+	if !ok {
+		v = &shellVariable{}
+		vs.values[name] = v
+	}
+	v.unset = false
+	return v, nil
+}
+
+// declareArray makes name an array, associative or indexed, unless it is
+// one already. The value of a variable that was set becomes its element 0.
+func (vs *variableStore) declareArray(name string, associative bool) error {
+	v, err := vs.writable(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case associative && v.indexed != nil:
+		return fmt.Errorf("%s: cannot convert indexed to associative array", name)
+	case !associative && v.assoc != nil:
+		return fmt.Errorf("%s: cannot convert associative to indexed array", name)
+	case associative && v.assoc == nil:
+		v.assoc = map[string]string{}
+		if v.value != "" {
+			v.assoc["0"] = v.value
+		}
+	case !associative && v.indexed == nil:
+		v.indexed = map[int]string{}
+		if v.value != "" {
+			v.indexed[0] = v.value
+		}
+	}
+	v.value = ""
+	return nil
+}
+
+// assignArray replaces the elements of an array. name becomes an indexed
+// array unless it is an associative one already. Elements without a key
+// follow the previous one.
+func (vs *variableStore) assignArray(name string, entries []arrayEntry) error {
+	v, err := vs.writable(name)
+	if err != nil {
+		return err
+	}
+	if v.assoc != nil {
+		elements := map[string]string{}
+		for _, e := range entries {
+			if !e.keyed {
+				return fmt.Errorf("%s: %s: must use subscript when assigning associative array", name, e.value)
+			}
+			elements[e.key] = e.value
+		}
+		v.assoc = elements
+		return nil
+	}
+
+	elements := map[int]string{}
+	next := 0
+	for _, e := range entries {
+		if e.keyed {
+			if next, err = vs.arrayIndex(name, e.key, elements); err != nil {
+				return err
+			}
+		}
+		elements[next] = e.value
+		next++
+	}
+	v.value = ""
+	v.indexed = elements
+	return nil
+}
+
+// setElement assigns name[subscript], which makes name an indexed array if
+// it is not an array yet.
+func (vs *variableStore) setElement(name string, subscript string, value string) error {
+	v, err := vs.writable(name)
+	if err != nil {
+		return err
+	}
+	if v.assoc != nil {
+		v.assoc[subscript] = value
+		return nil
+	}
+	if v.indexed == nil {
+		if err := vs.declareArray(name, false); err != nil {
+			return err
+		}
+	}
+	i, err := vs.arrayIndex(name, subscript, v.indexed)
+	if err != nil {
+		return err
+	}
+	v.indexed[i] = value
+	return nil
+}
+
+// element looks up name[subscript]. A variable that is not an array has
+// just the element with index 0.
+func (vs *variableStore) element(name string, subscript string) (string, bool) {
+	v, ok := vs.values[name]
+	if !ok {
+		return "", false
+	}
+	if v.assoc != nil {
+		value, ok := v.assoc[subscript]
+		return value, ok
+	}
+	i, err := vs.arrayIndex(name, subscript, v.indexed)
+	if err != nil {
+		return "", false
+	}
+	if v.indexed == nil {
+		return v.value, i == 0
+	}
+	value, ok := v.indexed[i]
+	return value, ok
+}
+
+// elements returns the keys and values of an array, ordered by index or,
+// for an associative array, by key.
+func (vs *variableStore) elements(name string) ([]string, []string) {
+	v, ok := vs.values[name]
+	switch {
+	case !ok:
+		return nil, nil
+	case v.assoc != nil:
+		keys := make([]string, 0, len(v.assoc))
+		for key := range v.assoc {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		values := make([]string, len(keys))
+		for i, key := range keys {
+			values[i] = v.assoc[key]
+		}
+		return keys, values
+	case v.indexed != nil:
+		indexes := sortedIndexes(v.indexed)
+		keys := make([]string, len(indexes))
+		values := make([]string, len(indexes))
+		for i, index := range indexes {
+			keys[i] = strconv.Itoa(index)
+			values[i] = v.indexed[index]
+		}
+		return keys, values
+	}
+	return []string{"0"}, []string{v.value}
+}
+
+// unsetElement removes name[subscript] from an array.
+func (vs *variableStore) unsetElement(name string, subscript string) error {
+	v, ok := vs.values[name]
+	switch {
+	case !ok:
+		return nil
+	case v.readonly:
+		return fmt.Errorf("%s: cannot unset: readonly variable", name)
+	case v.assoc != nil:
+		delete(v.assoc, subscript)
+		return nil
+	case v.indexed == nil:
+		return vs.unset(name)
+	}
+	i, err := vs.arrayIndex(name, subscript, v.indexed)
+	if err != nil {
+		return err
+	}
+	delete(v.indexed, i)
+	return nil
+}
+
+// arrayIndex evaluates the subscript of an indexed array. A negative index
+// counts back from the end of elements.
+func (vs *variableStore) arrayIndex(name string, subscript string, elements map[int]string) (int, error) {
+	n, err := evaluateArithmetic(subscript, vs)
+	if err != nil {
+		return 0, err
+	}
+	i := int(n)
+	if i < 0 {
+		if indexes := sortedIndexes(elements); len(indexes) > 0 {
+			i += indexes[len(indexes)-1] + 1
+		}
+		if i < 0 {
+			return 0, fmt.Errorf("%s[%s]: bad array subscript", name, subscript)
+		}
+	}
+	return i, nil
+}
+
+func sortedIndexes(elements map[int]string) []int {
+	indexes := make([]int, 0, len(elements))
+	for i := range elements {
+		indexes = append(indexes, i)
+	}
+	slices.Sort(indexes)
+	return indexes
+}
+
+// setPipeStatus records the statuses of the commands of the last pipeline
+// in PIPESTATUS.
+func (vs *variableStore) setPipeStatus(statuses []int) {
+	elements := map[int]string{}
+	for i, status := range statuses {
+		elements[i] = strconv.Itoa(status)
+	}
+	vs.values["PIPESTATUS"] = &shellVariable{indexed: elements}
+}
+
+// fieldSeparators is the value of IFS, or space, tab and newline when IFS
+// is unset.
+func (vs *variableStore) fieldSeparators() string {
+	if ifs, ok := vs.get("IFS"); ok {
+		return ifs
+	}
+	return " \t\n"
+}
+
+func (vs *variableStore) unset(name string) error {
+	v, ok := vs.values[name]
+	if !ok {
+		return nil
+	}
+	if v.readonly {
+		return fmt.Errorf("%s: cannot unset: readonly variable", name)
+	}
+	delete(vs.values, name)
+	if vs.syncEnv && v.exported {
+		os.Unsetenv(name)
+	}
+	return nil
+}
+
+func (vs *variableStore) export(name string) {
+	v, ok := vs.values[name]
+	if !ok {
+		v = &shellVariable{unset: true}
+		vs.values[name] = v
+	}
+	v.exported = true
+	vs.syncVariable(name)
+}
+
+func (vs *variableStore) unexport(name string) {
+	v, ok := vs.values[name]
+	if !ok || !v.exported {
+		return
+	}
+	v.exported = false
+	if vs.syncEnv {
+		os.Unsetenv(name)
+	}
+}
+
+func (vs *variableStore) markReadonly(name string) {
+	v, ok := vs.values[name]
+	if !ok {
+		v = &shellVariable{unset: true}
+		vs.values[name] = v
+	}
+	v.readonly = true
+}
+
+func (vs *variableStore) syncVariable(name string) {
+	v := vs.values[name]
+	if vs.syncEnv && v.exported && !v.unset && !v.isArray() {
+		os.Setenv(name, v.value)
+	}
+}
+
+// environ builds the NAME=value list handed to child processes.
+func (vs *variableStore) environ() []string {
+	environment := []string{}
+	for _, name := range vs.sortedNames() {
+		v := vs.values[name]
+		if v.exported && !v.unset && !v.isArray() {
+			environment = append(environment, name+"="+v.value)
+		}
+	}
+	return environment
+}
+
+// environWith returns the environment for a single command, with its
+// prefix assignments layered on top of the exported variables.
+func (vs *variableStore) environWith(assignments []assignment) []string {
+	environment := vs.environ()
+	for _, a := range assignments {
+		environment = append(removeFromEnviron(environment, a.name), a.name+"="+a.value)
+	}
+	return environment
+}
+
+// applyTemporary exports the prefix assignments of a builtin for the duration
+// of the call and returns a function that restores the previous values.
+func (vs *variableStore) applyTemporary(assignments []assignment) (func(), error) {
+	saved := map[string]*shellVariable{}
+	for _, a := range assignments {
+		if v, ok := vs.values[a.name]; ok && v.readonly {
+			return func() {}, &readonlyError{name: a.name}
+		}
+	}
+	for _, a := range assignments {
+		if _, seen := saved[a.name]; !seen {
+			var previous *shellVariable
+			if v, ok := vs.values[a.name]; ok {
+				copied := *v
+				previous = &copied
+			}
+			saved[a.name] = previous
+		}
+		vs.values[a.name] = &shellVariable{value: a.value, exported: true}
+	}
+	return func() {
+		for name, previous := range saved {
+			if previous == nil {
+				delete(vs.values, name)
+				continue
+			}
+			vs.values[name] = previous
+		}
+	}, nil
+}
+
+// pushScope starts a function call with its own positional parameters.
+func (vs *variableStore) pushScope(positional []string) {
+	vs.scopes = append(vs.scopes, &scope{positional: vs.positional, saved: map[string]*shellVariable{}})
+	vs.positional = positional
+}
+
+// popScope ends the innermost function call, restoring the positional
+// parameters and the variables it declared local.
+func (vs *variableStore) popScope() {
+	s := vs.scopes[len(vs.scopes)-1]
+	vs.scopes = vs.scopes[:len(vs.scopes)-1]
+	vs.positional = s.positional
+	for name, previous := range s.saved {
+		current, ok := vs.values[name]
+		if previous == nil {
+			delete(vs.values, name)
+			if vs.syncEnv && ok && current.exported {
+				os.Unsetenv(name)
+			}
+			continue
+		}
+		vs.values[name] = previous
+		vs.syncVariable(name)
+	}
+}
+
+// makeLocal gives name a fresh, unset value that lasts until the innermost
+// function call returns.
+func (vs *variableStore) makeLocal(name string) error {
+	if len(vs.scopes) == 0 {
+		return fmt.Errorf("can only be used in a function")
+	}
+	current, ok := vs.values[name]
+	if ok && current.readonly {
+		return &readonlyError{name: name}
+	}
+	s := vs.scopes[len(vs.scopes)-1]
+	if _, seen := s.saved[name]; seen {
+		return nil
+	}
+	s.saved[name] = current
+	delete(vs.values, name)
+	if vs.syncEnv && ok && current.exported {
+		os.Unsetenv(name)
+	}
+	return nil
+}
+
+func (vs *variableStore) sortedNames() []string {
+	names := make([]string, 0, len(vs.values))
+	for name := range vs.values {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func printVariables(out io.Writer, vs *variableStore, flag string) {
+	for _, name := range vs.sortedNames() {
+		v := vs.values[name]
+		if (flag == "-x" && !v.exported) || (flag == "-r" && !v.readonly) {
+			continue
+		}
+		fmt.Fprintln(out, vs.declaration(name, strconv.Quote))
+	}
+}
+
+// declaration describes a variable and its attributes as the declare
+// command that recreates it, the way declare -p shows it. quote writes the
+// values, and the keys that are not plain words, as shell text.
+func (vs *variableStore) declaration(name string, quote func(string) string) string {
+	v := vs.values[name]
+	flags := ""
+	switch {
+	case v.indexed != nil:
+		flags += "a"
+	case v.assoc != nil:
+		flags += "A"
+	}
+	if v.readonly {
+		flags += "r"
+	}
+	if v.exported {
+		flags += "x"
+	}
+	if flags == "" {
+		flags = "-"
+	}
+	if v.unset {
+		return fmt.Sprintf("declare -%s %s", flags, name)
+	}
+	if !v.isArray() {
+		return fmt.Sprintf("declare -%s %s=%s", flags, name, quote(v.value))
+	}
+	keys, values := vs.elements(name)
+	elements := make([]string, len(keys))
+	for i, key := range keys {
+		if strings.IndexFunc(key, func(r rune) bool { return r > 127 || !isNameChar(byte(r)) }) >= 0 {
+			key = quote(key)
+		}
+		elements[i] = fmt.Sprintf("[%s]=%s", key, quote(values[i]))
+	}
+	return fmt.Sprintf("declare -%s %s=(%s)", flags, name, strings.Join(elements, " "))
+}
+
+func removeFromEnviron(environment []string, name string) []string {
+	filtered := []string{}
+	for _, e := range environment {
+		if !strings.HasPrefix(e, name+"=") {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
+
+func isValidName(name string) bool {
+	if name == "" || !isNameStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !isNameChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isNameStart(ch byte) bool {
+	return ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ch == '_'
+}
+
+func isNameChar(ch byte) bool {
+	return isNameStart(ch) || isDigit(ch)
+}
+
+func isSpecialParam(ch byte) bool {
+	return ch == '?' || ch == '$' || ch == '!' || ch == '#' || ch == '@' || ch == '*'
+}
@@ -2,6 +2,7 @@ module github.com/codecrafters-io/shell-starter-go
 
 go 1.24.0
 
-require golang.org/x/term v0.36.0
-
-require golang.org/x/sys v0.37.0 // indirect
+require (
+	golang.org/x/sys v0.37.0
+	golang.org/x/term v0.36.0
+)